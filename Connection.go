@@ -17,123 +17,420 @@
    Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
 
 */
-
 package main
 
 import (
 	"code.google.com/p/go.net/websocket"
 	"encoding/json"
-	"io"
+	"fmt"
+	"sync"
 	"time"
 )
 
 // represents one end of a web socket and has facilities for sending and receiving messages via chans
 type Connection struct {
-	Socket    *websocket.Conn    //the socket that the connection wraps
+	Socket    *websocket.Conn    //the socket that the connection wraps, replaced when a worker reconnects so use GetSocket
 	OutChan   chan WorkerMessage // the out box. send messages with c.OutChan<-msg
 	InChan    chan WorkerMessage // the in box. getmsg:=<-c.InChan
 	ReConChan chan WorkerMessage
 	DiedChan  chan int // send died message out on this
 	isWorker  bool     // indicates if this connection is for a worker node
+	socketMu  sync.RWMutex
+	died      bool           // the current socket's death has been sent on DiedChan
+	protocol  WelcomeMsgBody // agreed with the other end, guarded by socketMu
+	caps      Capabilities
+
+	sending  chan int // token held while writing numbered messages so replays after a reconnect keep their order
+	window   chan int // a token for each unacknowledged message
+	delivery delivery
+
+	closed    chan int // closed by Close, once the connection is no longer used
+	closeOnce sync.Once
 }
 
 // Wraps a web socket in a connection starts routines that receive and send messages
 func NewConnection(Socket *websocket.Conn, isWorker bool) *Connection {
-	n := Connection{Socket: Socket,
+	n := &Connection{Socket: Socket,
 		OutChan:   make(chan WorkerMessage, conbuffersize),
 		InChan:    make(chan WorkerMessage, conbuffersize),
 		ReConChan: make(chan WorkerMessage, 0),
 		DiedChan:  make(chan int, 1),
-		isWorker:  isWorker}
-	go n.GetMsgs()
+		isWorker:  isWorker,
+		sending:   make(chan int, 1),
+		window:    make(chan int, maxunacked),
+		closed:    make(chan int)}
+	n.sending <- 1
+	go n.GetMsgs(Socket)
 	go n.SendMsgs()
-	return &n
+	go n.AckMsgs()
+	return n
+}
+
+// a master and a worker connection joined by their channels, used to run a worker in the master's process.
+// messages are passed as they are, neither connection has a socket and both speak the LocalProtocol
+func NewLocalConnections() (master *Connection, worker *Connection) {
+	toMaster := make(chan WorkerMessage, conbuffersize)
+	toWorker := make(chan WorkerMessage, conbuffersize)
+	master = &Connection{
+		OutChan:   toWorker,
+		InChan:    toMaster,
+		ReConChan: make(chan WorkerMessage, 0),
+		DiedChan:  make(chan int, 1),
+		closed:    make(chan int)}
+	worker = &Connection{
+		OutChan:   toMaster,
+		InChan:    toWorker,
+		ReConChan: make(chan WorkerMessage, 0),
+		DiedChan:  make(chan int, 1),
+		isWorker:  true,
+		closed:    make(chan int)}
+	master.SetProtocol(LocalProtocol())
+	worker.SetProtocol(LocalProtocol())
+	return
+}
+
+func (con *Connection) GetSocket() *websocket.Conn {
+	con.socketMu.RLock()
+	defer con.socketMu.RUnlock()
+	return con.Socket
+}
+
+func (con *Connection) SetSocket(ws *websocket.Conn) {
+	con.socketMu.Lock()
+	defer con.socketMu.Unlock()
+	con.Socket = ws
+	con.died = false
+}
+
+// false while the socket is dead and hasn't been replaced
+func (con *Connection) Connected() bool {
+	con.socketMu.RLock()
+	defer con.socketMu.RUnlock()
+	return !con.died
+}
+
+// marks ws as dead if it is still the current socket, returns false if it has already been replaced
+func (con *Connection) socketDied(ws *websocket.Conn) bool {
+	con.socketMu.Lock()
+	defer con.socketMu.Unlock()
+	if con.Socket != ws {
+		return false
+	}
+	con.died = true
+	return true
+}
+
+// records the protocol version and capabilities agreed with the other end, until then only the original messages are sent
+func (con *Connection) SetProtocol(protocol WelcomeMsgBody) {
+	con.socketMu.Lock()
+	defer con.socketMu.Unlock()
+	con.protocol = protocol
+	con.caps = NewCapabilities(protocol.Capabilities)
+}
+
+func (con *Connection) Protocol() WelcomeMsgBody {
+	con.socketMu.RLock()
+	defer con.socketMu.RUnlock()
+	return con.protocol
+}
+
+// false for optional message types the other end hasn't agreed to
+func (con *Connection) Allows(msgType int) bool {
+	con.socketMu.RLock()
+	defer con.socketMu.RUnlock()
+	return con.caps.Allows(msgType)
 }
 
-// monitor OutChan and sends any messages through web socket usually started in NewConnection
-func (con Connection) SendMsgs() {
+// true if the other end reads frames holding several messages
+func (con *Connection) Batches() bool {
+	con.socketMu.RLock()
+	defer con.socketMu.RUnlock()
+	return con.caps[BATCHCAPABILITY]
+}
+
+// monitor OutChan and sends any messages through web socket usually started in NewConnection.
+// if the other end reads batches, output messages wait up to batchmillis to be sent in one frame with those after them.
+// results the other end doesn't take go to the task's stderr, as invalid ones do, and other messages it doesn't handle are dropped
+func (con *Connection) SendMsgs() {
+	var failed *websocket.Conn
+	var flush <-chan time.Time
+	pending := []WorkerMessage{}
+	pendingbytes := 0
+	dropped := map[int]bool{}
 	for {
-		msg := <-con.OutChan
+		select {
+		case msg := <-con.OutChan:
+			if msg.flushed != nil {
+				failed = con.write(pending, failed)
+				pending, pendingbytes, flush = pending[:0], 0, nil
+				close(msg.flushed)
+				continue
+			}
+			if msg.Type == RESULT && !con.Allows(RESULT) {
+				msg.Type = CERROR
+				msg.Body = fmt.Sprintf("result from task %v/%d/%d the master doesn't collect: %s\n", msg.SubId, msg.LineId, msg.JobId, msg.Body)
+			}
+			if !con.Allows(msg.Type) {
+				if !dropped[msg.Type] {
+					dropped[msg.Type] = true
+					logger.Printf("WARNING SendMsgs() dropping messages of type %d, the other end doesn't handle them", msg.Type)
+				} else {
+					logger.Debug("SendMsgs(): dropping message type %d, the other end doesn't handle it", msg.Type)
+				}
+				continue
+			}
+
+			pending = append(pending, msg)
+			pendingbytes += msg.size()
+			if Batchable(msg.Type) && batchmillis > 0 && con.Batches() && len(pending) < batchmessages && pendingbytes < batchbytes {
+				if flush == nil {
+					flush = time.After(time.Duration(batchmillis) * time.Millisecond)
+				}
+				continue
+			}
+		case <-flush:
+		}
+		failed = con.write(pending, failed)
+		pending, pendingbytes, flush = pending[:0], 0, nil
+	}
+}
 
-		msgjson, err := json.Marshal(msg)
+// writes messages, in one frame if the other end reads batches. when both ends acknowledge messages they are numbered
+// and held until acknowledged, and messages that can't be written are replayed once the socket is replaced. otherwise
+// writing is retried until it succeeds. returns the socket writing failed on
+func (con *Connection) write(msgs []WorkerMessage, failed *websocket.Conn) *websocket.Conn {
+	if len(msgs) == 0 {
+		return failed
+	}
+	acking := con.Allows(ACK)
+	if acking {
+		for range msgs {
+			con.window <- 1
+		}
+		<-con.sending
+		defer func() { con.sending <- 1 }()
+	}
+
+	msgjsons := make([][]byte, 0, len(msgs))
+	for i := range msgs {
+		var msgjson []byte
+		var err error
+		if acking {
+			msgjson, err = con.hold(&msgs[i])
+		} else {
+			msgjson, err = json.Marshal(msgs[i])
+		}
 		if err != nil {
 			logger.Warn(err)
-			return
+			if acking {
+				<-con.window
+			}
+			continue
+		}
+		msgjsons = append(msgjsons, msgjson)
+	}
+
+	frames := msgjsons
+	if con.Batches() && len(msgjsons) > 1 {
+		frame, err := EncodeFrame(msgjsons, framecompression)
+		if err != nil {
+			logger.Warn(err)
+		} else {
+			frames = [][]byte{frame}
+		}
+	}
+
+	for _, frame := range frames {
+		if acking {
+			if ws := con.GetSocket(); ws != failed {
+				if err := WriteFrame(ws, frame); err != nil {
+					logger.Warn(err)
+					failed = ws
+				}
+			}
+			continue
 		}
 
-		//try to send over and over.
+		//try to send over and over, the socket may be replaced by a reconnect in the meantime.
 		for {
-			if _, err := con.Socket.Write(msgjson); err != nil {
+			if err := WriteFrame(con.GetSocket(), frame); err != nil {
 				logger.Warn(err)
 			} else {
 				break
 			}
 			<-time.After(time.Duration(2) * time.Second)
 		}
+	}
+	return failed
+}
 
+// closes the socket and stops acknowledging, for a connection that won't be used again
+func (con *Connection) Close() {
+	if ws := con.GetSocket(); ws != nil {
+		ws.Close()
 	}
+	con.closeOnce.Do(func() { close(con.closed) })
 }
 
-// monitor web socket and put messages in the InChan usually started in NewConnection
-func (con Connection) GetMsgs() {
-	for {
-		decoder := json.NewDecoder(con.Socket)
-		var msg WorkerMessage
-		err := decoder.Decode(&msg)
-		if err != nil {
-			logger.Warn(err)
+// waits until every message already in OutChan has been written (or, for local connections, received) and
+// acknowledged if the other end acknowledges messages, returns false on timeout
+func (con *Connection) Flush(timeout time.Duration) bool {
+	flushed := make(chan int)
+	deadline := time.After(timeout)
+	select {
+	case con.OutChan <- WorkerMessage{flushed: flushed}:
+	case <-deadline:
+		return false
+	}
+	select {
+	case <-flushed:
+	case <-deadline:
+		return false
+	}
+	for len(con.window) > 0 {
+		select {
+		case <-time.After(time.Duration(100) * time.Millisecond):
+		case <-deadline:
+			return false
 		}
+	}
+	return true
+}
 
-		switch {
-		case err == io.EOF:
-			remote := con.Socket.RemoteAddr().String()
-			con.Socket.Close()
-			if con.isWorker {
+// reads one message from a web socket
+func ReadMsg(ws *websocket.Conn) (msg WorkerMessage, err error) {
+	var frame []byte
+	if err = websocket.Message.Receive(ws, &frame); err != nil {
+		return
+	}
+	msgs, err := DecodeFrame(frame)
+	if err == nil && len(msgs) != 1 {
+		err = fmt.Errorf("expected a single message, got %d", len(msgs))
+	}
+	if len(msgs) > 0 {
+		msg = msgs[0]
+	}
+	return
+}
 
-				con.DiedChan <- 1
-				msg := <-con.ReConChan
-				msgjson, err := json.Marshal(msg)
-				if err != nil {
-					logger.Warn(err)
+// monitor web socket and put messages in the InChan, started in NewConnection and for each replacement socket
+func (con *Connection) GetMsgs(ws *websocket.Conn) {
+	for {
+		var frame []byte
+		if err := websocket.Message.Receive(ws, &frame); err != nil {
+			logger.Warn(err)
+			ws.Close()
+			if con.socketDied(ws) == false {
+				//a newer socket has taken over
+				return
+			}
+			if con.isWorker {
+				if con.Reconnect(ws) {
+					ws = con.GetSocket()
+					continue
 				}
+				DieIn(10)
+			}
+			con.DiedChan <- 1
+			return
+		}
 
-				reconnected := false
-
-				for t := 1; t < 16; t = t * 2 {
-
-					logger.Printf("Attempting reconnect in %v seconds.", t)
-					<-time.After(time.Duration(t) * time.Second)
-					logger.Printf("Attempting reconnect now.")
+		msgs, err := DecodeFrame(frame)
+		if err != nil {
+			logger.Printf("Connection read error %v", err)
+		}
+		for _, msg := range msgs {
+			con.deliver(ws, msg)
+		}
+	}
+}
 
-					ws, err := DialWebSocket(remote)
-					if err != nil {
-						logger.Warn(err)
-						continue
-					}
+// handles acknowledgements and replays itself and puts other messages in the InChan
+func (con *Connection) deliver(ws *websocket.Conn, msg WorkerMessage) {
+	if msg.Type == ACK {
+		con.acknowledged(msg.Ack)
+		return
+	}
+	if msg.MsgSeq > 0 && con.receive(ws, msg.MsgSeq) == false {
+		return
+	}
+	if msg.Type == WELCOME && msg.ErrMsg == "" {
+		con.welcomed(msg)
+	}
+	con.InChan <- msg
+}
 
-					if _, err = ws.Write(msgjson); err != nil {
-						logger.Warn(err)
-					} else {
-						reconnected = true
-						con.Socket = ws
-						break
-					}
+// redials the master after the socket dies and sends the HELLO provided on ReConChan, returns false if the master can't be reached.
+// messages the master hasn't received are replayed once its WELCOME says where it got to
+func (con *Connection) Reconnect(dead *websocket.Conn) bool {
+	remote := dead.RemoteAddr().String()
+	con.DiedChan <- 1
+	msg := <-con.ReConChan
+	msgjson, err := json.Marshal(msg)
+	if err != nil {
+		logger.Warn(err)
+	}
 
-				}
-				if reconnected != true {
-					DieIn(10)
-				}
+	for t := 1; t < 16; t = t * 2 {
+		logger.Printf("Attempting reconnect in %v seconds.", t)
+		<-time.After(time.Duration(t) * time.Second)
+		logger.Printf("Attempting reconnect now.")
 
-			}
-			con.DiedChan <- 1
-			return //TODO: recover
+		ws, err := DialWebSocket(remote)
+		if err != nil {
+			logger.Warn(err)
+			continue
+		}
 
-			decoder = json.NewDecoder(con.Socket)
-		case err != nil:
-			logger.Printf("Connection read error %v", err)
+		if _, err = ws.Write(msgjson); err != nil {
+			logger.Warn(err)
+			ws.Close()
 			continue
+		}
+		con.resume(ws)
+		return true
+	}
+	return false
+}
 
+// reads the master's reply to a reconnecting HELLO, replays what the master is missing and swaps in the socket.
+// a master that doesn't reply within 10 seconds speaks the original protocol and nothing is replayed
+func (con *Connection) resume(ws *websocket.Conn) {
+	<-con.sending
+	defer func() { con.sending <- 1 }()
+
+	ws.SetReadDeadline(time.Now().Add(time.Duration(10) * time.Second))
+	msg, err := ReadMsg(ws)
+	ws.SetReadDeadline(time.Time{})
+	welcome := &WelcomeMsgBody{}
+	if err == nil && msg.Type == WELCOME && msg.ErrMsg == "" {
+		if welcome, err = NewWelcomeMsgBody(msg.Body); err != nil {
+			logger.Warn(err)
+			welcome = &WelcomeMsgBody{}
 		}
-		con.InChan <- msg
+		logger.Printf("resuming with protocol version %d, the master received %d messages", welcome.ProtocolVersion, welcome.Received)
 	}
+	con.SetProtocol(*welcome)
+	replay := con.Resync(welcome.Session, welcome.Received)
+	if con.Allows(ACK) {
+		Replay(ws, replay)
+	}
+	con.SetSocket(ws)
+
+	//anything but the WELCOME is handled as usual, including a refusal
+	if err == nil && (msg.Type != WELCOME || msg.ErrMsg != "") {
+		con.deliver(ws, msg)
+	}
+}
+
+// swaps in the socket of a worker that has reconnected, returns true if the death of the old one was sent on DiedChan.
+// the caller should then read from the new socket with GetMsgs
+func (con *Connection) Replace(ws *websocket.Conn) bool {
+	con.socketMu.Lock()
+	old, died := con.Socket, con.died
+	con.Socket = ws
+	con.died = false
+	con.socketMu.Unlock()
+	old.Close()
+	return died
 }
@@ -20,10 +20,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
-	"os"
-	"strings"
+	"path/filepath"
+	"strconv"
 	"time"
 )
 
@@ -32,13 +33,27 @@ type Submission struct {
 	Details chan JobDetails
 	Tasks   []Task
 
-	CoutFileChan  chan string
-	CerrFileChan  chan string
-	ErrorChan     chan *WorkerJob
-	FinishedChan  chan *WorkerJob
+	CoutFileChan  chan TaskOutput
+	CerrFileChan  chan TaskOutput
+	CoutFeed      *OutputFeed
+	CerrFeed      *OutputFeed
+	ResultChan    chan TaskResult
+	ErrorChan     chan *EndedWorkerJob
+	FinishedChan  chan *EndedWorkerJob
 	SubmittedChan chan *SubmitedWorkerJob
+	StartedChan   chan *SubmitedWorkerJob
+	RetriedChan   chan *WorkerJob
+	jobChan       chan *WorkerJob
+	chunks        *ChunkSequencer
+	sink          OutputSink
 	stopChan      chan int
+	stopped       chan int // tells MonitorWorkTasks the job was stopped
+	handedOut     chan int // the number of tasks SubmitJobs handed out, once it returns
 	doneChan      chan int
+	writersDone   chan int     // sent by each output writer once its files are closed
+	coutEnded     chan TaskEnd // tasks that have ended, for the writers of ordered and split output
+	cerrEnded     chan TaskEnd
+	Completed     chan int // closed once every task has finished or errored, or every task handed out of a stopped job has
 }
 
 func NewSubmission(jd JobDetails, tasks []Task, jobChan chan *WorkerJob) *Submission {
@@ -46,19 +61,42 @@ func NewSubmission(jd JobDetails, tasks []Task, jobChan chan *WorkerJob) *Submis
 	s := Submission{
 		Details:       make(chan JobDetails, 1),
 		Tasks:         tasks,
-		CoutFileChan:  make(chan string, iobuffersize),
-		CerrFileChan:  make(chan string, iobuffersize),
-		ErrorChan:     make(chan *WorkerJob, 1),
-		FinishedChan:  make(chan *WorkerJob, 1),
+		CoutFileChan:  make(chan TaskOutput, iobuffersize),
+		CerrFileChan:  make(chan TaskOutput, iobuffersize),
+		CoutFeed:      NewOutputFeed(),
+		CerrFeed:      NewOutputFeed(),
+		ResultChan:    make(chan TaskResult, iobuffersize),
+		ErrorChan:     make(chan *EndedWorkerJob, 1),
+		FinishedChan:  make(chan *EndedWorkerJob, 1),
 		SubmittedChan: make(chan *SubmitedWorkerJob, 1),
+		StartedChan:   make(chan *SubmitedWorkerJob, 1),
+		RetriedChan:   make(chan *WorkerJob, 1),
+		jobChan:       jobChan,
+		chunks:        NewChunkSequencer(),
 		stopChan:      make(chan int, 3),
-		doneChan:      make(chan int, 0)}
+		stopped:       make(chan int, 1),
+		handedOut:     make(chan int, 1),
+		doneChan:      make(chan int, 0),
+		writersDone:   make(chan int, 0),
+		Completed:     make(chan int)}
+
+	if jd.OutputFiles == ORDEREDFILES || jd.OutputFiles == SPLITFILES {
+		s.coutEnded = make(chan TaskEnd, iobuffersize)
+		s.cerrEnded = make(chan TaskEnd, iobuffersize)
+	}
 
+	sink, err := GetOutputSink(jd.OutputSink)
+	if err != nil {
+		logger.Warn(err)
+		sink = LocalSink{}
+	}
+	s.sink = sink
 	s.Details <- jd
 
 	go s.MonitorWorkTasks()
 	go s.WriteCout()
 	go s.WriteCerror()
+	go s.WriteResults()
 	go s.SubmitJobs(jobChan)
 
 	return &s
@@ -74,6 +112,10 @@ func (this *Submission) Stop() bool {
 		select {
 		case this.stopChan <- 1:
 			this.SetState(COMPLETE, STOPPED)
+			select {
+			case this.stopped <- 1:
+			default:
+			}
 			logger.Debug("Stop():%v", this.SniffDetails())
 		case <-time.After(250000000):
 			logger.Printf("Stop(): timeout stopping: %v", dtls.JobId)
@@ -93,51 +135,182 @@ func (this *Submission) SniffDetails() JobDetails {
 func (this *Submission) MonitorWorkTasks() {
 	logger.Debug("MonitorWorkTasks()")
 	dtls := <-this.Details
-	logFile, err := os.Create(fmt.Sprintf("%v.log.txt", dtls.JobId))
+	logFile, err := CreateOutputFile(this.sink, dtls.OutputFile(dtls.LogSuffix()), dtls.Compression)
 	if err != nil {
 		logger.Warn(err)
+		logFile = discardOutput{}
 	}
 	this.Details <- dtls
-	defer logFile.Close()
+	jobLog := NewJobLog(logFile, dtls.LogFormat)
+	defer jobLog.Close()
 
+	var finalizer *WorkerJob
+	stopping := false
+	handedOut := -1
 	for {
 		select {
-		case wj := <-this.ErrorChan:
+		case ewj := <-this.ErrorChan:
+			wj := ewj.wj
+			event := NewEndedEvent(ewj, true)
+			if finalizer != nil && wj.Key() == finalizer.Key() {
+				event.Finalizer = true
+				jobLog.Log(event)
+				this.Complete(jobLog, FAIL, 1)
+				return
+			}
+			this.EndTask(ewj)
 			dtls := <-this.Details
 			dtls.Progress.Errored = 1 + dtls.Progress.Errored
 			dtls.LastModified = time.Now().String()
 			this.Details <- dtls
-			fmt.Fprintf(logFile, "ERRORED %v %v %v %v\n", wj.SubId, wj.JobId, wj.LineId, strings.Join(wj.Args, " "))
+			jobLog.Log(event)
 
 			logger.Debug("ERROR [%v,%v]", dtls.JobId, dtls.Progress.Errored)
 
-		case wj := <-this.FinishedChan:
+		case ewj := <-this.FinishedChan:
+			wj := ewj.wj
+			event := NewEndedEvent(ewj, false)
+			if finalizer != nil && wj.Key() == finalizer.Key() {
+				event.Finalizer = true
+				jobLog.Log(event)
+				this.Complete(jobLog, SUCCESS, 1)
+				return
+			}
+			this.EndTask(ewj)
 			dtls := <-this.Details
 			dtls.Progress.Finished = 1 + dtls.Progress.Finished
 			dtls.LastModified = time.Now().String()
 			this.Details <- dtls
-
-			fmt.Fprintf(logFile, "FINISHED %v %v %v %v\n", wj.SubId, wj.JobId, wj.LineId, strings.Join(wj.Args, " "))
+			jobLog.Log(event)
 
 			logger.Debug("FINISHED [%v,%v]", dtls.JobId, dtls.Progress.Finished)
+		case wj := <-this.RetriedChan:
+			jobLog.Log(NewLogEvent(RETRIEDEVENT, wj))
 		case swj := <-this.SubmittedChan:
-			fmt.Fprintf(logFile, "SUBMITTED to %v %v %v %v %v\n", swj.host, swj.wj.SubId, swj.wj.JobId, swj.wj.LineId, strings.Join(swj.wj.Args, " "))
-
+			event := NewLogEvent(SUBMITTEDEVENT, swj.wj)
+			event.Host = swj.host
+			jobLog.Log(event)
+		case swj := <-this.StartedChan:
+			event := NewLogEvent(STARTEDEVENT, swj.wj)
+			event.Host = swj.host
+			jobLog.Log(event)
+		case <-this.stopped:
+			stopping = true
+		case n := <-this.handedOut:
+			handedOut = n
 		}
 
 		dtls := this.SniffDetails()
-		if dtls.Progress.isComplete() {
-			fmt.Fprintln(logFile, "COMPLETED")
-			logger.Debug("COMPLETED [%v]", dtls)
-			this.SetState(COMPLETE, SUCCESS)
-			this.doneChan <- 1
-			this.doneChan <- 1
-			logger.Debug("COMPLETED [%v]: DONE", dtls.JobId)
+		if finalizer == nil && stopping && handedOut >= 0 && dtls.Progress.Finished+dtls.Progress.Errored >= handedOut {
+			//the tasks handed out before the stop have ended
+			this.Complete(jobLog, STOPPED, 3)
+			return
+		}
+		if finalizer == nil && dtls.Progress.isComplete() {
+			if dtls.Finalizer != nil && dtls.State == RUNNING {
+				//the job's files are closed first so the finalizer can read them
+				this.StopWriters(3)
+				go this.WriteFinalizerOutput()
+				finalizer = this.Finalize(dtls)
+				event := NewLogEvent(FINALIZINGEVENT, finalizer)
+				event.Finalizer = true
+				jobLog.Log(event)
+				continue
+			}
+			this.Complete(jobLog, SUCCESS, 3)
 			return
 		}
 	}
 }
 
+// lets the writers of ordered and split output and the raw output chunk sequencer know a task has ended and how many
+// messages of output to wait for
+func (this *Submission) EndTask(ewj *EndedWorkerJob) {
+	wj := ewj.wj
+	cout, cerr := -1, -1
+	if ewj.counts != nil {
+		cout, cerr = ewj.counts.Stdout, ewj.counts.Stderr
+	}
+	if wj.OutputMode == RAWOUTPUT {
+		this.chunks.End(ChunkStream(&WorkerMessage{Type: COUT, SubId: wj.SubId, LineId: wj.LineId, JobId: wj.JobId, Attempt: wj.Attempt}), cout)
+		this.chunks.End(ChunkStream(&WorkerMessage{Type: CERROR, SubId: wj.SubId, LineId: wj.LineId, JobId: wj.JobId, Attempt: wj.Attempt}), cerr)
+	}
+	if this.coutEnded != nil {
+		this.coutEnded <- TaskEnd{LineId: wj.LineId, JobId: wj.JobId, Attempt: wj.Attempt, Messages: cout}
+		this.cerrEnded <- TaskEnd{LineId: wj.LineId, JobId: wj.JobId, Attempt: wj.Attempt, Messages: cerr}
+	}
+}
+
+// marks the job complete with the given status once its running output writers have closed their files. a job that
+// was stopped or errored meanwhile keeps that status, whatever its finalizer did
+func (this *Submission) Complete(jobLog *JobLog, status string, writers int) {
+	dtls := this.SniffDetails()
+	logger.Debug("COMPLETED [%v]", dtls)
+	if dtls.State == COMPLETE && (dtls.Status == STOPPED || dtls.Status == ERROR) {
+		status = dtls.Status
+	}
+	this.SetState(COMPLETE, status)
+	event := NewLogEvent(COMPLETEDEVENT, nil)
+	event.SubId = dtls.JobId
+	event.Status = status
+	jobLog.Log(event)
+	this.StopWriters(writers)
+	this.chunks.Clear()
+	close(this.Completed)
+	logger.Debug("COMPLETED [%v]: DONE", dtls.JobId)
+}
+
+// tells the output writers to stop and waits until they have closed their files
+func (this *Submission) StopWriters(writers int) {
+	for i := 0; i < writers; i++ {
+		this.doneChan <- 1
+	}
+	for i := 0; i < writers; i++ {
+		<-this.writersDone
+	}
+}
+
+// submits the job's finalizer, the paths of the job's files and its task counts are passed in its environment.
+// the paths are absolute on the master, workers rewrite them with their pathmap
+func (this *Submission) Finalize(dtls JobDetails) *WorkerJob {
+	logger.Debug("Finalize(%v)", dtls.JobId)
+	abs := func(fpath string) string {
+		if a, err := filepath.Abs(fpath); err == nil {
+			return a
+		}
+		return fpath
+	}
+	stdout := CompressedPath(dtls.OutputFile(".out.txt"), dtls.Compression)
+	stderr := CompressedPath(dtls.OutputFile(".err.txt"), dtls.Compression)
+	if dtls.OutputFiles == SPLITFILES {
+		stdout = SplitOutputDir(dtls.OutputDir, dtls.JobId)
+		stderr = stdout
+	}
+
+	wj := NewTaskJob(dtls, *dtls.Finalizer, len(this.Tasks), dtls.Progress.Total)
+	wj.Env = []string{
+		"GOLEM_OUTPUT_DIR=" + abs(dtls.OutputDir),
+		"GOLEM_STDOUT=" + abs(stdout),
+		"GOLEM_STDERR=" + abs(stderr),
+		"GOLEM_RESULTS=" + abs(CompressedPath(dtls.OutputFile(".results.jsonl"), dtls.Compression)),
+		"GOLEM_LOG=" + abs(CompressedPath(dtls.OutputFile(dtls.LogSuffix()), dtls.Compression)),
+		"GOLEM_TASKS_TOTAL=" + strconv.Itoa(dtls.Progress.Total),
+		"GOLEM_TASKS_FINISHED=" + strconv.Itoa(dtls.Progress.Finished),
+		"GOLEM_TASKS_ERRORED=" + strconv.Itoa(dtls.Progress.Errored),
+	}
+	go func() {
+		this.jobChan <- wj
+	}()
+	return wj
+}
+
+// builds the WorkerJob running one task of the job
+func NewTaskJob(dtls JobDetails, task Task, lineId int, taskId int) *WorkerJob {
+	return &WorkerJob{SubId: dtls.JobId, LineId: lineId, JobId: taskId, Args: task.Args, Dir: task.Dir, Inputs: task.Inputs, Outputs: task.Outputs,
+		BundleHash: dtls.BundleHash, BundleName: dtls.BundleName, OutputMode: task.OutputMode, Attribution: dtls.Attribution, Executor: task.Executor, IdMode: task.IdMode,
+		OutputLimits: dtls.OutputLimits}
+}
+
 func (this *Submission) SubmitJobs(jobChan chan *WorkerJob) {
 	logger.Debug("SubmitJobs()")
 
@@ -149,39 +322,104 @@ func (this *Submission) SubmitJobs(jobChan chan *WorkerJob) {
 		logger.Debug("Submitting [%d,%v]", lineId, vals)
 		for i := 0; i < vals.Count; i++ {
 			select {
-			case jobChan <- &WorkerJob{SubId: dtls.JobId, LineId: lineId, JobId: taskId, Args: vals.Args}:
+			case jobChan <- NewTaskJob(dtls, vals, lineId, taskId):
 				taskId++
 			case <-this.stopChan:
 				logger.Printf("submission stopped [%d, %v]", taskId, dtls.JobId)
-				return //TODO: add indication that we stopped
+				this.handedOut <- taskId
+				return
 			}
 		}
 	}
 	logger.Printf("tasks submitted [%d, %v]", taskId, dtls.JobId)
+	this.handedOut <- taskId
 
 }
 
+// submits a task lost with its worker again, once it has been attempted maxattempts times or the job is stopped it is counted as errored
+func (this *Submission) Requeue(wj *WorkerJob) {
+	logger.Debug("Requeue(%v)", wj.Key())
+	if wj.Attempt+1 >= maxattempts || this.SniffDetails().State != RUNNING {
+		this.ErrorChan <- &EndedWorkerJob{wj: wj, errmsg: "lost with its worker"}
+		return
+	}
+	retry := *wj
+	retry.Attempt++
+	this.RetriedChan <- &retry
+	this.jobChan <- &retry
+}
+
+// submits a task a worker handed back without starting it again, as the same attempt. once the job is stopped it is counted as errored
+func (this *Submission) Return(wj *WorkerJob) {
+	logger.Debug("Return(%v)", wj.Key())
+	if this.SniffDetails().State != RUNNING {
+		this.ErrorChan <- &EndedWorkerJob{wj: wj, errmsg: "handed back by a draining worker"}
+		return
+	}
+	this.jobChan <- wj
+}
+
+// writes a raw output chunk once the chunks produced before it by the same task have been written
+func (this *Submission) WriteChunk(msg *WorkerMessage) {
+	out := this.CoutFileChan
+	if msg.Type == CERROR {
+		out = this.CerrFileChan
+	}
+	this.chunks.Add(ChunkStream(msg), msg.Chunk, func(data []byte) {
+		out <- TaskOutput{LineId: msg.LineId, JobId: msg.JobId, Attempt: msg.Attempt, Text: string(data)}
+	})
+}
+
 func (this *Submission) WriteCout() {
 	dtls := this.SniffDetails()
 	logger.Debug("WriteCout(%v)", dtls.JobId)
+	defer func() {
+		this.writersDone <- 1
+	}()
+	defer this.CoutFeed.Close()
+	if dtls.OutputFiles == SPLITFILES {
+		this.WriteSplit(this.CoutFileChan, this.coutEnded, this.CoutFeed, "stdout")
+		return
+	}
+	if dtls.OutputFiles == ORDEREDFILES {
+		this.WriteOrdered(this.CoutFileChan, this.coutEnded, this.CoutFeed, "stdout", ".out.txt")
+		return
+	}
 
 	var stdOutFile io.WriteCloser = nil
+	var index *OutputIndex
+	limiter := NewOutputLimiter(dtls.OutputLimits.JobBytes, dtls.OutputLimits.JobLines)
 	var err error
 
 	for {
 		select {
 		case msg := <-this.CoutFileChan:
 			if stdOutFile == nil {
-				if stdOutFile, err = os.Create(fmt.Sprintf("%v.out.txt", dtls.JobId)); err != nil {
+				outpath := dtls.OutputFile(".out.txt")
+				if stdOutFile, err = CreateOutputFile(this.sink, outpath, dtls.Compression); err != nil {
 					logger.Warn(err)
-				}
-				if stdOutFile != nil {
+					stdOutFile = discardOutput{}
+				} else {
 					defer stdOutFile.Close()
 				}
+				if index, err = NewOutputIndex(this.sink, outpath); err != nil {
+					logger.Warn(err)
+				} else {
+					defer index.Close()
+				}
 			}
 
-			fmt.Fprint(stdOutFile, msg)
+			msg = this.LimitJobOutput(limiter, "stdout", msg)
+			n, _ := fmt.Fprint(stdOutFile, msg.Text)
+			this.CoutFeed.Publish(msg.Text)
+			if index != nil {
+				index.Add(msg.LineId, msg.JobId, n)
+			}
 		case <-time.After(time.Second):
+			if index != nil {
+				index.Flush()
+			}
+			FlushOutput(stdOutFile)
 			//logger.Debug("checking for done: %v", dtls.JobId)
 			select {
 			case <-this.doneChan:
@@ -197,24 +435,53 @@ func (this *Submission) WriteCout() {
 func (this *Submission) WriteCerror() {
 	dtls := this.SniffDetails()
 	logger.Debug("WriteCerror(%v)", dtls.JobId)
+	defer func() {
+		this.writersDone <- 1
+	}()
+	defer this.CerrFeed.Close()
+	if dtls.OutputFiles == SPLITFILES {
+		this.WriteSplit(this.CerrFileChan, this.cerrEnded, this.CerrFeed, "stderr")
+		return
+	}
+	if dtls.OutputFiles == ORDEREDFILES {
+		this.WriteOrdered(this.CerrFileChan, this.cerrEnded, this.CerrFeed, "stderr", ".err.txt")
+		return
+	}
 
 	var stdErrFile io.WriteCloser = nil
+	var index *OutputIndex
+	limiter := NewOutputLimiter(dtls.OutputLimits.JobBytes, dtls.OutputLimits.JobLines)
 	var err error
 
 	for {
 		select {
 		case errmsg := <-this.CerrFileChan:
 			if stdErrFile == nil {
-				if stdErrFile, err = os.Create(fmt.Sprintf("%v.err.txt", dtls.JobId)); err != nil {
+				errpath := dtls.OutputFile(".err.txt")
+				if stdErrFile, err = CreateOutputFile(this.sink, errpath, dtls.Compression); err != nil {
 					logger.Warn(err)
-				}
-				if stdErrFile != nil {
+					stdErrFile = discardOutput{}
+				} else {
 					defer stdErrFile.Close()
 				}
+				if index, err = NewOutputIndex(this.sink, errpath); err != nil {
+					logger.Warn(err)
+				} else {
+					defer index.Close()
+				}
 			}
 
-			fmt.Fprint(stdErrFile, errmsg)
+			errmsg = this.LimitJobOutput(limiter, "stderr", errmsg)
+			n, _ := fmt.Fprint(stdErrFile, errmsg.Text)
+			this.CerrFeed.Publish(errmsg.Text)
+			if index != nil {
+				index.Add(errmsg.LineId, errmsg.JobId, n)
+			}
 		case <-time.After(time.Second):
+			if index != nil {
+				index.Flush()
+			}
+			FlushOutput(stdErrFile)
 			//logger.Debug("checking for done: %v", dtls.JobId)
 			select {
 			case <-this.doneChan:
@@ -227,6 +494,246 @@ func (this *Submission) WriteCerror() {
 	}
 }
 
+// writes the results tasks send to the job's results file, one JSON TaskResult per line.
+// results of an attempt older than one already seen are dropped, readers keep only each task's latest attempt
+func (this *Submission) WriteResults() {
+	dtls := this.SniffDetails()
+	logger.Debug("WriteResults(%v)", dtls.JobId)
+	defer func() {
+		this.writersDone <- 1
+	}()
+
+	var resultFile io.WriteCloser
+	attempts := map[int]int{}
+	for {
+		select {
+		case result := <-this.ResultChan:
+			if result.Attempt < attempts[result.TaskId] {
+				logger.Printf("WARNING WriteResults() dropping result of lost attempt %d of task %d", result.Attempt, result.TaskId)
+				continue
+			}
+			attempts[result.TaskId] = result.Attempt
+			if resultFile == nil {
+				f, err := CreateOutputFile(this.sink, dtls.OutputFile(".results.jsonl"), dtls.Compression)
+				if err != nil {
+					logger.Warn(err)
+					resultFile = discardOutput{}
+				} else {
+					resultFile = f
+					defer f.Close()
+				}
+			}
+			line, err := json.Marshal(result)
+			if err != nil {
+				logger.Warn(err)
+				continue
+			}
+			resultFile.Write(append(line, '\n'))
+		case <-time.After(time.Second):
+			FlushOutput(resultFile)
+			select {
+			case <-this.doneChan:
+				logger.Debug("stop chan: %v", dtls.JobId)
+				return
+			default:
+			}
+		}
+	}
+}
+
+// writes the output and results of the job's finalizer to their own files
+func (this *Submission) WriteFinalizerOutput() {
+	dtls := this.SniffDetails()
+	logger.Debug("WriteFinalizerOutput(%v)", dtls.JobId)
+	defer func() {
+		this.writersDone <- 1
+	}()
+
+	files := map[string]io.WriteCloser{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	write := func(suffix string, data []byte) {
+		f, isin := files[suffix]
+		if !isin {
+			var err error
+			if f, err = CreateOutputFile(this.sink, dtls.OutputFile(suffix), dtls.Compression); err != nil {
+				logger.Warn(err)
+				f = discardOutput{}
+			}
+			files[suffix] = f
+		}
+		f.Write(data)
+	}
+
+	for {
+		select {
+		case msg := <-this.CoutFileChan:
+			write(".finalizer.out.txt", []byte(msg.Text))
+		case msg := <-this.CerrFileChan:
+			write(".finalizer.err.txt", []byte(msg.Text))
+		case result := <-this.ResultChan:
+			line, err := json.Marshal(result)
+			if err != nil {
+				logger.Warn(err)
+				continue
+			}
+			write(".finalizer.results.jsonl", append(line, '\n'))
+		case <-time.After(time.Second):
+			for _, f := range files {
+				FlushOutput(f)
+			}
+			select {
+			case <-this.doneChan:
+				logger.Debug("stop chan: %v", dtls.JobId)
+				return
+			default:
+			}
+		}
+	}
+}
+
+// writes the output read from ch to the job's merged file in task order, each task's output once it and
+// the tasks before it have ended. the feed gets output as it arrives so it can still be tailed
+func (this *Submission) WriteOrdered(ch chan TaskOutput, ended chan TaskEnd, feed *OutputFeed, stream string, suffix string) {
+	dtls := this.SniffDetails()
+	logger.Debug("WriteOrdered(%v,%v)", dtls.JobId, stream)
+
+	outpath := dtls.OutputFile(suffix)
+	outFile, err := CreateOutputFile(this.sink, outpath, dtls.Compression)
+	if err != nil {
+		logger.Warn(err)
+		outFile = discardOutput{}
+	}
+	defer outFile.Close()
+	index, err := NewOutputIndex(this.sink, outpath)
+	if err != nil {
+		logger.Warn(err)
+	} else {
+		defer index.Close()
+	}
+	out := NewOrderedOutput(outFile, index)
+	defer func() {
+		if err := out.Close(); err != nil {
+			logger.Warn(err)
+		}
+	}()
+
+	limiter := NewOutputLimiter(dtls.OutputLimits.JobBytes, dtls.OutputLimits.JobLines)
+	write := func(msg TaskOutput) {
+		msg = this.LimitJobOutput(limiter, stream, msg)
+		if err := out.Write(msg); err != nil {
+			logger.Warn(err)
+		}
+		feed.Publish(msg.Text)
+	}
+
+	for {
+		select {
+		case msg := <-ch:
+			write(msg)
+		case end := <-ended:
+			//output the task sent before it ended can still be waiting in ch, the rest is waited for if its count is known
+			for drained := false; !drained; {
+				select {
+				case msg := <-ch:
+					write(msg)
+				default:
+					drained = true
+				}
+			}
+			if err := out.End(end); err != nil {
+				logger.Warn(err)
+			}
+		case <-time.After(time.Second):
+			if index != nil {
+				index.Flush()
+			}
+			FlushOutput(outFile)
+			select {
+			case <-this.doneChan:
+				logger.Debug("stop chan: %v", dtls.JobId)
+				return
+			default:
+			}
+		}
+	}
+}
+
+// writes the output read from ch to one file per task, closing a task's file once ended says it is done
+func (this *Submission) WriteSplit(ch chan TaskOutput, ended chan TaskEnd, feed *OutputFeed, stream string) {
+	dtls := this.SniffDetails()
+	logger.Debug("WriteSplit(%v,%v)", dtls.JobId, stream)
+
+	out := NewSplitOutput(this.sink, dtls.OutputDir, dtls.JobId, stream, dtls.Compression)
+	limiter := NewOutputLimiter(dtls.OutputLimits.JobBytes, dtls.OutputLimits.JobLines)
+	defer out.Close()
+	write := func(msg TaskOutput) {
+		msg = this.LimitJobOutput(limiter, stream, msg)
+		if err := out.Write(msg); err != nil {
+			logger.Warn(err)
+		}
+		feed.Publish(msg.Text)
+	}
+
+	for {
+		select {
+		case msg := <-ch:
+			write(msg)
+		case end := <-ended:
+			//as for ordered output, write what the task sent before it ended first
+			for drained := false; !drained; {
+				select {
+				case msg := <-ch:
+					write(msg)
+				default:
+					drained = true
+				}
+			}
+			if err := out.End(end); err != nil {
+				logger.Warn(err)
+			}
+		case <-time.After(time.Second):
+			out.Flush()
+			select {
+			case <-this.doneChan:
+				logger.Debug("stop chan: %v", dtls.JobId)
+				return
+			default:
+			}
+		}
+	}
+}
+
+// cuts output off once the job has passed its limits for the stream, what is dropped is added to the job's overage
+func (this *Submission) LimitJobOutput(limiter *OutputLimiter, stream string, out TaskOutput) TaskOutput {
+	droppedBytes, droppedLines := limiter.DroppedBytes, limiter.DroppedLines
+	out.Text = limiter.Limit(out.Text, "job "+stream)
+	if limiter.DroppedBytes == droppedBytes {
+		return out
+	}
+
+	overage := OutputOverage{StdoutBytes: limiter.DroppedBytes - droppedBytes, StdoutLines: limiter.DroppedLines - droppedLines}
+	if stream == "stderr" {
+		overage = OutputOverage{StderrBytes: overage.StdoutBytes, StderrLines: overage.StdoutLines}
+	}
+	x := <-this.Details
+	x.Overage.Add(overage)
+	this.Details <- x
+	return out
+}
+
+// records the output a task wrote past its limits
+func (this *Submission) AddTaskOverage(overage *OutputOverage) {
+	x := <-this.Details
+	x.Overage.Add(*overage)
+	x.TruncatedTasks++
+	x.LastModified = time.Now().String()
+	this.Details <- x
+}
+
 func (this *Submission) SetState(state string, status string) {
 	logger.Debug("SetState(%v,%v):before=%v", state, status, this.SniffDetails())
 	x := <-this.Details
@@ -0,0 +1,59 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// a job stopped while its finalizer runs stays STOPPED when the finalizer then finishes
+func TestStoppedJobKeepsStatusAfterFinalizer(t *testing.T) {
+	jobChan := make(chan *WorkerJob, 1)
+	jd := JobDetails{JobId: "A1B2C3", OutputDir: t.TempDir(), Finalizer: &Task{Count: 1, Args: []string{"combine"}},
+		Progress: TaskProgress{Total: 1}}
+	s := NewSubmission(jd, []Task{{Count: 1, Args: []string{"task"}}}, jobChan)
+
+	next := func() *WorkerJob {
+		select {
+		case wj := <-jobChan:
+			return wj
+		case <-time.After(time.Duration(5) * time.Second):
+			t.Fatal("no task was handed out")
+		}
+		return nil
+	}
+
+	s.FinishedChan <- &EndedWorkerJob{wj: next()}
+	finalizer := next()
+	if !s.Stop() {
+		t.Fatal("the job wasn't running while its finalizer was")
+	}
+	s.FinishedChan <- &EndedWorkerJob{wj: finalizer}
+
+	select {
+	case <-s.Completed:
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("the job didn't complete")
+	}
+	if dtls := s.SniffDetails(); dtls.State != COMPLETE || dtls.Status != STOPPED {
+		t.Fatalf("completed as %v %v, expected %v %v", dtls.State, dtls.Status, COMPLETE, STOPPED)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// location on the master of the bundle with the given content hash
+func BundlePath(hash string) string {
+	return filepath.Join(stagedir, ".bundles", filepath.Base(hash))
+}
+
+// saves the optional "bundle" file of a job submission under its sha256 hash, returns an empty hash if there is none
+func StoreBundle(r *http.Request) (hash string, name string, err error) {
+	logger.Debug("StoreBundle(%v)", r.URL.Path)
+	if r.MultipartForm == nil || len(r.MultipartForm.File["bundle"]) == 0 {
+		return
+	}
+
+	fh := r.MultipartForm.File["bundle"][0]
+	name = filepath.Base(fh.Filename)
+	src, err := fh.Open()
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	defer src.Close()
+
+	dir := filepath.Dir(BundlePath(""))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		logger.Warn(err)
+		return
+	}
+	partial := filepath.Join(dir, UniqueId()+".part")
+	f, err := os.Create(partial)
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(src, stagemaxbytes+1))
+	f.Close()
+	if err == nil && n > stagemaxbytes {
+		err = fmt.Errorf("bundle %v is larger than %d bytes", name, stagemaxbytes)
+	}
+	if err != nil {
+		logger.Warn(err)
+		os.Remove(partial)
+		return
+	}
+
+	hash = fmt.Sprintf("%x", h.Sum(nil))
+	if err = os.Rename(partial, BundlePath(hash)); err != nil {
+		logger.Warn(err)
+		os.Remove(partial)
+	}
+	return
+}
+
+// a bundle unpacked on a worker and the jobs using it
+type CachedBundle struct {
+	dir    string
+	subIds map[string]bool
+	ready  chan int // closed once the bundle is unpacked
+	err    error
+}
+
+// fetches each job bundle once and keeps it unpacked until every job using it completes. bundles are kept by hash and
+// name, as the name decides how the bundle is unpacked
+type BundleCache struct {
+	mu      sync.Mutex
+	stager  *Stager
+	bundles map[string]*CachedBundle
+}
+
+func NewBundleCache(stager *Stager) *BundleCache {
+	return &BundleCache{stager: stager, bundles: map[string]*CachedBundle{}}
+}
+
+// returns the directory the job's bundle is unpacked in, fetching it if this is the first task to need it
+func (this *BundleCache) Get(job *WorkerJob) (string, error) {
+	logger.Debug("Get(%v,%v,%v)", job.SubId, job.BundleHash, job.BundleName)
+	key := job.BundleHash + "/" + job.BundleName
+	this.mu.Lock()
+	cb, isin := this.bundles[key]
+	if !isin {
+		cb = &CachedBundle{dir: BundleDir(job), subIds: map[string]bool{}, ready: make(chan int)}
+		this.bundles[key] = cb
+	}
+	cb.subIds[job.SubId] = true
+	this.mu.Unlock()
+
+	if isin {
+		<-cb.ready
+		return cb.dir, cb.err
+	}
+
+	if cb.err = this.Fetch(job, cb.dir); cb.err != nil {
+		logger.Warn(cb.err)
+		this.mu.Lock()
+		delete(this.bundles, key)
+		this.mu.Unlock()
+	}
+	close(cb.ready)
+	return cb.dir, cb.err
+}
+
+// removes bundles that are no longer used by any job once the given job has completed
+func (this *BundleCache) Release(subId string) {
+	logger.Debug("Release(%v)", subId)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for key, cb := range this.bundles {
+		if !cb.subIds[subId] {
+			continue
+		}
+		delete(cb.subIds, subId)
+		if len(cb.subIds) == 0 {
+			logger.Printf("removing bundle %v", cb.dir)
+			delete(this.bundles, key)
+			if err := os.RemoveAll(cb.dir); err != nil {
+				logger.Warn(err)
+			}
+			//the hash's directory goes once no bundle of that content is left under another name
+			os.Remove(filepath.Dir(cb.dir))
+		}
+	}
+}
+
+// where a worker unpacks the job's bundle, under its hash and then its name
+func BundleDir(job *WorkerJob) string {
+	return filepath.Join(scratchdir, "golem", "bundles", filepath.Base(job.BundleHash), filepath.Base(job.BundleName))
+}
+
+// downloads a bundle, checks it against its hash and unpacks it into dir, a directory left by an earlier fetch is reused
+func (this *BundleCache) Fetch(job *WorkerJob, dir string) error {
+	logger.Debug("Fetch(%v,%v)", job.BundleHash, dir)
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		return nil
+	}
+
+	partial := dir + ".part"
+	os.RemoveAll(partial)
+	defer os.RemoveAll(partial)
+	if err := os.MkdirAll(partial, 0755); err != nil {
+		return err
+	}
+
+	archive := partial + ".download"
+	defer os.Remove(archive)
+	if err := this.stager.Download("/stage/bundle/"+job.BundleHash, archive); err != nil {
+		return err
+	}
+	if sum, _, err := FileChecksum(archive); err != nil {
+		return err
+	} else if sum != job.BundleHash {
+		return fmt.Errorf("bundle %v: expected sha256 %v, downloaded %v", job.BundleName, job.BundleHash, sum)
+	}
+
+	if err := UnpackBundle(archive, job.BundleName, partial); err != nil {
+		return err
+	}
+	return os.Rename(partial, dir)
+}
+
+// unpacks tar and gzipped tar bundles into dir, any other bundle is treated as a single executable script
+func UnpackBundle(archive string, name string, dir string) error {
+	logger.Debug("UnpackBundle(%v,%v)", name, dir)
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case strings.HasSuffix(name, ".tar"):
+	default:
+		return CopyFile(f, filepath.Join(dir, filepath.Base(name)), 0755)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := SafeJoin(dir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := CopyFile(tr, target, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return err
+			}
+		default:
+			logger.Printf("UnpackBundle(): skipping %v", hdr.Name)
+		}
+	}
+}
+
+func CopyFile(r io.Reader, dest string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a bundle cache fetching from a stage controller, with the master's stagedir and the worker's scratchdir under t's temp dir
+func testBundleCache(t *testing.T) *BundleCache {
+	oldstage, oldscratch, oldtls := stagedir, scratchdir, useTls
+	stagedir, scratchdir, useTls = t.TempDir(), t.TempDir(), false
+	server := httptest.NewServer(StageController{})
+	t.Cleanup(func() {
+		server.Close()
+		stagedir, scratchdir, useTls = oldstage, oldscratch, oldtls
+	})
+	return NewBundleCache(NewStager(strings.TrimPrefix(server.URL, "http://"), ""))
+}
+
+// stores content as the master does for a job submission, returns its hash
+func stageBundle(t *testing.T, content []byte) string {
+	hash := fmt.Sprintf("%x", sha256.Sum256(content))
+	if err := os.MkdirAll(filepath.Dir(BundlePath(hash)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(BundlePath(hash), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// the same content submitted as a tarball and as a script is unpacked once for each name
+func TestBundleCacheKeysOnName(t *testing.T) {
+	cache := testBundleCache(t)
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	tw.WriteHeader(&tar.Header{Name: "run.sh", Mode: 0755, Size: 4, Typeflag: tar.TypeReg})
+	tw.Write([]byte("true"))
+	tw.Close()
+	hash := stageBundle(t, tarball.Bytes())
+
+	tardir, err := cache.Get(&WorkerJob{SubId: "A", BundleHash: hash, BundleName: "tools.tar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptdir, err := cache.Get(&WorkerJob{SubId: "B", BundleHash: hash, BundleName: "tools.sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tardir == scriptdir {
+		t.Fatalf("both names unpacked in %v", tardir)
+	}
+	if _, err := os.Stat(filepath.Join(tardir, "run.sh")); err != nil {
+		t.Fatalf("tarball not unpacked: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(scriptdir, "tools.sh")); err != nil {
+		t.Fatalf("script not copied: %v", err)
+	}
+
+	cache.Release("A")
+	if _, err := os.Stat(scriptdir); err != nil {
+		t.Fatalf("releasing one name removed the other: %v", err)
+	}
+	cache.Release("B")
+	if _, err := os.Stat(filepath.Dir(scriptdir)); !os.IsNotExist(err) {
+		t.Fatalf("the hash's directory is left after both names are released: %v", err)
+	}
+}
+
+func TestBundleFetchChecksHash(t *testing.T) {
+	cache := testBundleCache(t)
+	hash := stageBundle(t, []byte("echo hello"))
+	if err := ioutil.WriteFile(BundlePath(hash), []byte("echo replaced"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	job := &WorkerJob{SubId: "A", BundleHash: hash, BundleName: "hello.sh"}
+	if _, err := cache.Get(job); err == nil {
+		t.Fatal("a bundle that doesn't match its hash was unpacked")
+	}
+	if _, err := os.Stat(BundleDir(job)); !os.IsNotExist(err) {
+		t.Fatalf("a bundle that doesn't match its hash was left in %v", BundleDir(job))
+	}
+}
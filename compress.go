@@ -0,0 +1,235 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// compression of a job's output files
+const (
+	NOCOMPRESSION   = "none" // the default
+	GZIPCOMPRESSION = "gzip"
+	ZSTDCOMPRESSION = "zstd"
+)
+
+// extension added to the name of an output file written with each compression
+var compressionExtensions = map[string]string{GZIPCOMPRESSION: ".gz", ZSTDCOMPRESSION: ".zst"}
+
+func ValidCompression(value string) error {
+	switch value {
+	case "", NOCOMPRESSION, GZIPCOMPRESSION, ZSTDCOMPRESSION:
+		return nil
+	}
+	return fmt.Errorf("invalid compression %q (expected %v, %v or %v)", value, NOCOMPRESSION, GZIPCOMPRESSION, ZSTDCOMPRESSION)
+}
+
+// the name an output file is written under with the given compression
+func CompressedPath(fpath string, compression string) string {
+	return fpath + compressionExtensions[compression]
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// an output file and the streaming compressor writing to it
+type CompressedFile struct {
+	compressor
+	file io.WriteCloser
+}
+
+func (cf *CompressedFile) Close() error {
+	err := cf.compressor.Close()
+	if ferr := cf.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// returns a writer compressing into f, which is closed with it. appending to a compressed file adds another
+// gzip member or zstd frame, which readers handle transparently
+func CompressOutput(f io.WriteCloser, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case GZIPCOMPRESSION:
+		return &CompressedFile{gzip.NewWriter(f), f}, nil
+	case ZSTDCOMPRESSION:
+		zw, err := zstd.NewWriter(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &CompressedFile{zw, f}, nil
+	}
+	return f, nil
+}
+
+// creates the output file fpath in the sink, with the compression's extension added
+func CreateOutputFile(sink OutputSink, fpath string, compression string) (io.WriteCloser, error) {
+	f, err := sink.Create(CompressedPath(fpath, compression))
+	if err != nil {
+		return nil, err
+	}
+	return CompressOutput(f, compression)
+}
+
+// writes out what the compressor of an output file is holding so readers see everything written so far
+func FlushOutput(w io.Writer) {
+	if cf, ok := w.(*CompressedFile); ok {
+		if err := cf.Flush(); err != nil {
+			logger.Warn(err)
+		}
+	}
+}
+
+// stands in for an output file that couldn't be created
+type discardOutput struct{}
+
+func (discardOutput) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardOutput) Close() error {
+	return nil
+}
+
+// finds the output file created as fpath with any compression, returns its actual path and compression
+func FindOutputFile(fpath string) (string, string, error) {
+	for _, compression := range []string{NOCOMPRESSION, GZIPCOMPRESSION, ZSTDCOMPRESSION} {
+		cpath := CompressedPath(fpath, compression)
+		if _, err := os.Stat(cpath); err == nil {
+			return cpath, compression, nil
+		}
+	}
+	return "", "", &os.PathError{Op: "open", Path: fpath, Err: os.ErrNotExist}
+}
+
+// a decompressing reader and the output file it reads from
+type DecompressedFile struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (df *DecompressedFile) Close() error {
+	err := df.ReadCloser.Close()
+	if ferr := df.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// opens the output file created as fpath with any compression for reading its uncompressed content
+func OpenOutputFile(fpath string) (io.ReadCloser, error) {
+	cpath, compression, err := FindOutputFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(cpath)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case GZIPCOMPRESSION:
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &DecompressedFile{zr, f}, nil
+	case ZSTDCOMPRESSION:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &DecompressedFile{zr.IOReadCloser(), f}, nil
+	}
+	return f, nil
+}
+
+// true if the request's Accept-Encoding header allows the given content coding
+func AcceptsEncoding(r *http.Request, coding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(accepted, ";")
+		if strings.TrimSpace(params[0]) != coding {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); strings.HasPrefix(param, "q=") && err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serves the files in the master's output directory. a request for an output file by its uncompressed name is
+// answered from the compressed file, as is with a Content-Encoding header if the client accepts it or decompressed if not
+type OutputFileServer struct {
+	dir   string
+	files http.Handler
+}
+
+func NewOutputFileServer(dir string) OutputFileServer {
+	return OutputFileServer{dir: dir, files: http.FileServer(http.Dir(dir))}
+}
+
+func (this OutputFileServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	fpath := SafeJoin(this.dir, r.URL.Path)
+	if _, err := os.Stat(fpath); err == nil {
+		this.files.ServeHTTP(rw, r)
+		return
+	}
+
+	cpath, compression, err := FindOutputFile(fpath)
+	if err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+	logger.Debug("ServeHTTP(%v): %v", r.URL.Path, cpath)
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Vary", "Accept-Encoding")
+	var content io.ReadCloser
+	if AcceptsEncoding(r, compression) {
+		rw.Header().Set("Content-Encoding", compression)
+		content, err = os.Open(cpath)
+	} else {
+		content, err = OpenOutputFile(fpath)
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+	if _, err := io.Copy(rw, content); err != nil {
+		logger.Warn(err)
+	}
+}
@@ -22,8 +22,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -87,21 +91,91 @@ func (this MasterJobController) Create(rw http.ResponseWriter, r *http.Request)
 	jobtype := GetHeader(r, "x-golem-job-type", "Unspecified")
 
 	jd := NewJobDetails(jobId, owner, label, jobtype, TotalTasks(tasks), SCHEDULED, READY)
+	jd.Attribution = GetHeader(r, "x-golem-job-attribution", "")
+	if _, err := ParseAttribution(jd.Attribution); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jd.OutputFiles = GetHeader(r, "x-golem-job-output-files", MERGEDFILES)
+	if err := ValidOutputFiles(jd.OutputFiles); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jd.Compression = GetHeader(r, "x-golem-job-compression", outputcompression)
+	if err := ValidCompression(jd.Compression); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jd.OutputLimits = outputlimits
+	if value := GetHeader(r, "x-golem-job-output-limits", ""); value != "" {
+		limits, err := ParseOutputLimits(value)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jd.OutputLimits = limits
+	}
+	jd.OutputSink = GetHeader(r, "x-golem-job-output-sink", outputsink)
+	if _, err := GetOutputSink(jd.OutputSink); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jd.OutputSubpath = GetHeader(r, "x-golem-job-output-subpath", "")
+	jd.OutputDir = JobOutputDir(jd)
+	jd.OutputUri = OutputUri(jd.OutputDir)
+	jd.LogFormat = joblogformat
+	finalizer, err := LoadFinalizerFromJson(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if finalizer != nil && !LocalOutputSink(jd.OutputSink) {
+		http.Error(rw, fmt.Sprintf("a finalizer reads the job's files from outputroot, output sink %q isn't local", jd.OutputSink), http.StatusBadRequest)
+		return
+	}
+	jd.Finalizer = finalizer
+
+	bundleHash, bundleName, err := StoreBundle(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jd.BundleHash = bundleHash
+	jd.BundleName = bundleName
 
 	logger.Debug("creating: %v", jobId)
+	sub := NewSubmission(jd, tasks, this.master.jobChan)
 	this.master.subMu.Lock()
-	this.master.subMap[jobId] = NewSubmission(jd, tasks, this.master.jobChan)
+	this.master.subMap[jobId] = sub
 	this.master.subMu.Unlock()
 	logger.Debug("created: %v", jobId)
 
+	if bundleHash != "" {
+		go this.master.CleanupOnCompletion(sub, jobId)
+	}
+
 	if err := json.NewEncoder(rw).Encode(jd); err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 	}
 }
 
-// GET /jobs/id
+// GET /jobs/id, GET /jobs/id/stdout (or stderr), GET /jobs/id/tasks or GET /jobs/id/tasks/lineid/taskid/stdout (or stderr)
 func (this MasterJobController) Find(rw http.ResponseWriter, id string) {
 	logger.Debug("Find(%v)", id)
+	if parts := strings.Split(id, "/"); len(parts) > 1 {
+		switch {
+		case parts[1] == "stdout" || parts[1] == "stderr":
+			this.TailOutput(rw, parts)
+		case parts[1] == "tasks" && len(parts) == 2:
+			this.ListTaskOutputs(rw, parts[0])
+		case parts[1] == "results":
+			this.FindResults(rw, parts)
+		default:
+			this.FindTaskOutput(rw, parts)
+		}
+		return
+	}
+
 	this.master.subMu.RLock()
 	s, isin := this.master.subMap[id]
 	this.master.subMu.RUnlock()
@@ -117,6 +191,172 @@ func (this MasterJobController) Find(rw http.ResponseWriter, id string) {
 	}
 }
 
+// GET /jobs/id/stdout (or stderr) with optional /offset/bytes, /tail/lines and /follow, the output of a running job
+// from the master's memory. the offset of the first byte returned is sent in the x-golem-output-offset header and
+// with follow the response continues, chunked, as output arrives until the job completes
+func (this MasterJobController) TailOutput(rw http.ResponseWriter, parts []string) {
+	logger.Debug("TailOutput(%v)", parts)
+	sub := this.master.GetSub(parts[0])
+	if sub == nil {
+		http.Error(rw, "job "+parts[0]+" not found", http.StatusNotFound)
+		return
+	}
+
+	var offset int64
+	tail := 0
+	follow := false
+	for i := 2; i < len(parts); i++ {
+		var err error
+		switch {
+		case parts[i] == "follow":
+			follow = true
+		case parts[i] == "offset" && i+1 < len(parts):
+			i++
+			offset, err = strconv.ParseInt(parts[i], 10, 64)
+		case parts[i] == "tail" && i+1 < len(parts):
+			i++
+			tail, err = strconv.Atoi(parts[i])
+		default:
+			err = fmt.Errorf("GET /jobs/id/%v[/offset/bytes][/tail/lines][/follow]", parts[1])
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	feed := sub.CoutFeed
+	if parts[1] == "stderr" {
+		feed = sub.CerrFeed
+	}
+	data, from, ch := feed.Read(offset, tail, follow)
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Header().Set("x-golem-output-offset", strconv.FormatInt(from, 10))
+	if ch == nil {
+		rw.Write(data)
+		return
+	}
+	defer feed.Unfollow(ch)
+	if _, err := rw.Write(data); err != nil {
+		return
+	}
+
+	//a follower that goes away while the job is quiet is noticed when its request ends, not only on a failed write
+	var gone <-chan struct{}
+	if rr, ok := rw.(RequestResponse); ok {
+		gone = rr.Request.Context().Done()
+	}
+	flusher, _ := rw.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case data, open := <-ch:
+			if !open {
+				return
+			}
+			if _, err := rw.Write(data); err != nil {
+				logger.Debug("TailOutput(%v): %v", parts[0], err)
+				return
+			}
+		case <-gone:
+			logger.Debug("TailOutput(%v): follower disconnected", parts[0])
+			return
+		}
+	}
+}
+
+// GET /jobs/id/tasks, the tasks that wrote output
+func (this MasterJobController) ListTaskOutputs(rw http.ResponseWriter, jobId string) {
+	logger.Debug("ListTaskOutputs(%v)", jobId)
+	items := ListTaskOutputs(this.master.OutputDir(jobId), jobId)
+	if err := json.NewEncoder(rw).Encode(TaskOutputFilesList{Items: items, NumberOfItems: len(items)}); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// GET /jobs/id/tasks/lineid/taskid/stdout (or stderr), the output of one task taken from its split output file or the job's merged output file
+func (this MasterJobController) FindTaskOutput(rw http.ResponseWriter, parts []string) {
+	logger.Debug("FindTaskOutput(%v)", parts)
+	if len(parts) != 5 || parts[1] != "tasks" {
+		http.Error(rw, "GET /jobs/id/tasks, GET /jobs/id/tasks/lineid/taskid/stdout or GET /jobs/id/tasks/lineid/taskid/stderr", http.StatusBadRequest)
+		return
+	}
+
+	lineId, err := strconv.Atoi(parts[2])
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	taskId, err := strconv.Atoi(parts[3])
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dir := this.master.OutputDir(parts[0])
+	var outpath string
+	switch parts[4] {
+	case "stdout":
+		outpath = filepath.Join(dir, parts[0]+".out.txt")
+	case "stderr":
+		outpath = filepath.Join(dir, parts[0]+".err.txt")
+	default:
+		http.Error(rw, "unknown output "+parts[4], http.StatusBadRequest)
+		return
+	}
+
+	if f, err := OpenOutputFile(SplitOutputPath(dir, parts[0], lineId, taskId, parts[4])); err == nil {
+		defer f.Close()
+		rw.Header().Set("Content-Type", "text/plain")
+		if _, err := io.Copy(rw, f); err != nil {
+			logger.Warn(err)
+		}
+		return
+	}
+
+	if _, err := os.Stat(IndexPath(outpath)); err != nil {
+		http.Error(rw, "no "+parts[4]+" for job "+parts[0], http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain")
+	if err := CopyTaskOutput(rw, outpath, lineId, taskId); err != nil {
+		logger.Warn(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// GET /jobs/id/results with optional /lineid and /taskid, the JSON records the job's tasks wrote to their result channel
+func (this MasterJobController) FindResults(rw http.ResponseWriter, parts []string) {
+	logger.Debug("FindResults(%v)", parts)
+	lineId, taskId, err := ParseResultFilter(parts)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := []TaskResult{}
+	f, err := OpenOutputFile(filepath.Join(this.master.OutputDir(parts[0]), parts[0]+".results.jsonl"))
+	switch {
+	case err == nil:
+		defer f.Close()
+		if results, err = ReadResults(f); err != nil {
+			logger.Warn(err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case this.master.GetSub(parts[0]) == nil:
+		http.Error(rw, "no results for job "+parts[0], http.StatusNotFound)
+		return
+	}
+
+	results = FilterResults(LatestResults(results), lineId, taskId)
+	if err := json.NewEncoder(rw).Encode(TaskResultList{Items: results, NumberOfItems: len(results)}); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
+
 // POST /jobs/id/stop or POST /jobs/id/kill
 func (this MasterJobController) Act(rw http.ResponseWriter, parts []string, r *http.Request) {
 	logger.Debug("Act(%v)", r.URL.Path)
@@ -170,6 +410,7 @@ func (this MasterJobController) Act(rw http.ResponseWriter, parts []string, r *h
 				_, isin := this.master.subMap[jobId]
 				if isin {
 					delete(this.master.subMap, jobId)
+					this.master.archived[jobId] = dtls.OutputDir
 				}
 				this.master.subMu.Unlock()
 			}()
@@ -217,7 +458,9 @@ func (this MasterNodeController) Find(rw http.ResponseWriter, nodeId string) {
 	}
 
 	logger.Debug("node found: %v", nodeId)
-	if err := json.NewEncoder(rw).Encode(NewWorkerNode(nh)); err != nil {
+	wn := NewWorkerNode(nh)
+	_, wn.History = nh.LatestMetrics()
+	if err := json.NewEncoder(rw).Encode(wn); err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 	}
 }
@@ -0,0 +1,72 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a follower of a quiet job that goes away is let go of when its request ends
+func TestFollowerGoesAway(t *testing.T) {
+	sub := &Submission{CoutFeed: NewOutputFeed(), CerrFeed: NewOutputFeed()}
+	jobs := MasterJobController{master: &Master{subMap: map[string]*Submission{"A1B2C3": sub}}}
+	served := make(chan int, 1)
+	//stands in for the jobs resource, whose Find is only given the response writer
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs/", func(rw http.ResponseWriter, r *http.Request) {
+		jobs.Find(rw, strings.TrimPrefix(r.URL.Path, "/jobs/"))
+		served <- 1
+	})
+	server := httptest.NewServer(WithRequests(mux))
+	defer server.Close()
+
+	sub.CoutFeed.Publish("first line\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/jobs/A1B2C3/stdout/follow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if line, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil || line != "first line\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("the follower's request ended but its output is still followed")
+	}
+	sub.CoutFeed.mu.Lock()
+	defer sub.CoutFeed.mu.Unlock()
+	if len(sub.CoutFeed.followers) != 0 {
+		t.Fatalf("%d followers left", len(sub.CoutFeed.followers))
+	}
+}
@@ -21,10 +21,13 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type ScribeJobController struct {
@@ -61,6 +64,10 @@ func (this ScribeJobController) Create(rw http.ResponseWriter, r *http.Request)
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if len(r.MultipartForm.File["bundle"]) > 0 {
+		http.Error(rw, "jobs with a bundle must be submitted to the master", http.StatusBadRequest)
+		return
+	}
 
 	jobId := UniqueId()
 	owner := GetHeader(r, "x-golem-job-owner", "Anonymous")
@@ -68,6 +75,42 @@ func (this ScribeJobController) Create(rw http.ResponseWriter, r *http.Request)
 	jobtype := GetHeader(r, "x-golem-job-type", "Unspecified")
 
 	job := NewJobDetails(jobId, owner, label, jobtype, TotalTasks(tasks), NEW, READY)
+	job.Attribution = GetHeader(r, "x-golem-job-attribution", "")
+	if _, err := ParseAttribution(job.Attribution); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job.OutputFiles = GetHeader(r, "x-golem-job-output-files", MERGEDFILES)
+	if err := ValidOutputFiles(job.OutputFiles); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	//left empty the master's default compression is used
+	job.Compression = GetHeader(r, "x-golem-job-compression", "")
+	if err := ValidCompression(job.Compression); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job.OutputSubpath = GetHeader(r, "x-golem-job-output-subpath", "")
+	finalizer, err := LoadFinalizerFromJson(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job.Finalizer = finalizer
+	//sinks are configured on the master, which checks the name
+	job.OutputSink = GetHeader(r, "x-golem-job-output-sink", "")
+	if finalizer != nil && job.OutputSink != "" && job.OutputSink != "local" {
+		http.Error(rw, fmt.Sprintf("a finalizer reads the job's files from outputroot, output sink %q isn't local", job.OutputSink), http.StatusBadRequest)
+		return
+	}
+	//left empty the master's default limits are used
+	limits, err := ParseOutputLimits(GetHeader(r, "x-golem-job-output-limits", ""))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job.OutputLimits = limits
 	if err := this.store.Create(job, tasks); err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
@@ -77,9 +120,33 @@ func (this ScribeJobController) Create(rw http.ResponseWriter, r *http.Request)
 	}
 }
 
-// GET /jobs/id
+// GET /jobs/id, or GET /jobs/id/stdout (or stderr), GET /jobs/id/tasks and GET /jobs/id/tasks/lineid/taskid/stdout (or stderr)
+// which are proxied to the master
 func (this ScribeJobController) Find(rw http.ResponseWriter, id string) {
 	logger.Debug("Find(%v)", id)
+	if parts := strings.Split(id, "/"); len(parts) > 1 && parts[1] == "results" {
+		if results, err := this.store.Results(parts[0]); err == nil && len(results) > 0 {
+			this.FindResults(rw, parts, results)
+			return
+		}
+	}
+	if strings.Contains(id, "/") {
+		preq, err := http.NewRequest("GET", "/jobs/"+id, strings.NewReader(""))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		//followed output stops being proxied once the client goes away
+		if rr, ok := rw.(RequestResponse); ok {
+			preq = preq.WithContext(rr.Request.Context())
+		}
+		proxy := httputil.NewSingleHostReverseProxy(this.target)
+		//passes on followed output as it arrives
+		proxy.FlushInterval = 100 * time.Millisecond
+		proxy.ServeHTTP(rw, preq)
+		return
+	}
+
 	jd, err := this.store.Get(id)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
@@ -90,6 +157,21 @@ func (this ScribeJobController) Find(rw http.ResponseWriter, id string) {
 	}
 }
 
+// GET /jobs/id/results[/lineid[/taskid]] answered from the results saved once the job completed
+func (this ScribeJobController) FindResults(rw http.ResponseWriter, parts []string, results []TaskResult) {
+	logger.Debug("FindResults(%v)", parts)
+	lineId, taskId, err := ParseResultFilter(parts)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results = FilterResults(LatestResults(results), lineId, taskId)
+	if err := json.NewEncoder(rw).Encode(TaskResultList{Items: results, NumberOfItems: len(results)}); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
+
 // POST /jobs/id/stop or POST /jobs/id/kill
 func (this ScribeJobController) Act(rw http.ResponseWriter, parts []string, r *http.Request) {
 	logger.Debug("Act(%v):%v", r.URL.Path, parts)
@@ -140,3 +222,21 @@ func (this ScribeClusterController) Index(rw http.ResponseWriter, params url.Val
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 	}
 }
+
+// GET /cluster/nodeId (snapshots of a single worker node over the last hour)
+func (this ScribeClusterController) Find(rw http.ResponseWriter, nodeId string) {
+	logger.Debug("Find(%v)", nodeId)
+
+	items, err := this.store.NodeStats(nodeId, 3600)
+	if err != nil {
+		logger.Warn(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nodeStatList := NodeStatList{Items: items, NumberOfItems: len(items)}
+	if err := json.NewEncoder(rw).Encode(nodeStatList); err != nil {
+		logger.Warn(err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
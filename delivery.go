@@ -0,0 +1,237 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// sent messages a connection holds for replay, SendMsgs waits for acknowledgements once there are this many
+const maxunacked = 10000
+
+// messages received before they are acknowledged, fewer are acknowledged every second
+const ackevery = 100
+
+var sessionOnce sync.Once
+var session string
+
+// identifies this process to the other end of its connections, so a restarted master or worker isn't sent the
+// replays meant for the process it replaced
+func Session() string {
+	sessionOnce.Do(func() { session = UniqueId() })
+	return session
+}
+
+// a message sent to the other end that it hasn't acknowledged yet
+type unackedMsg struct {
+	seq     uint64
+	msgjson []byte
+}
+
+// sequence numbers and unacknowledged messages of a connection whose ends agreed to the ack capability
+type delivery struct {
+	mu       sync.Mutex
+	peer     string       // session of the other end
+	sent     uint64       // sequence number of the last message sent
+	unacked  []unackedMsg // oldest first
+	received uint64       // sequence number of the last message received
+	acked    uint64       // the last received sequence number acknowledged
+}
+
+// numbers msg and holds it until it is acknowledged, call with the sending token held so replays keep their order
+func (con *Connection) hold(msg *WorkerMessage) ([]byte, error) {
+	con.delivery.mu.Lock()
+	defer con.delivery.mu.Unlock()
+	msg.MsgSeq = con.delivery.sent + 1
+	msgjson, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	con.delivery.sent = msg.MsgSeq
+	con.delivery.unacked = append(con.delivery.unacked, unackedMsg{msg.MsgSeq, msgjson})
+	return msgjson, nil
+}
+
+// drops the messages the other end has acknowledged, making room for more
+func (con *Connection) acknowledged(seq uint64) {
+	con.delivery.mu.Lock()
+	defer con.delivery.mu.Unlock()
+	n := 0
+	for n < len(con.delivery.unacked) && con.delivery.unacked[n].seq <= seq {
+		n++
+	}
+	con.delivery.unacked = con.delivery.unacked[n:]
+	for i := 0; i < n; i++ {
+		<-con.window
+	}
+}
+
+// records a numbered message from the other end, returns false if it is a replay of one already received or follows
+// messages that were lost. then ws is closed, so the reconnect replays everything after the last message received in order
+func (con *Connection) receive(ws *websocket.Conn, seq uint64) bool {
+	con.delivery.mu.Lock()
+	if seq <= con.delivery.received {
+		con.delivery.mu.Unlock()
+		logger.Debug("receive(%d): duplicate", seq)
+		return false
+	}
+	if seq != con.delivery.received+1 {
+		expected := con.delivery.received + 1
+		con.delivery.mu.Unlock()
+		logger.Warn("receive(%d): expected message %d, closing the socket to have the messages in between replayed", seq, expected)
+		ws.Close()
+		return false
+	}
+	con.delivery.received = seq
+	due := seq-con.delivery.acked >= ackevery
+	con.delivery.mu.Unlock()
+
+	if due {
+		con.ack(ws)
+	}
+	return true
+}
+
+// session of the other end, empty until it is known
+func (con *Connection) Peer() string {
+	con.delivery.mu.Lock()
+	defer con.delivery.mu.Unlock()
+	return con.delivery.peer
+}
+
+// sequence number of the last message received, sent in a HELLO or WELCOME so the other end replays only what is missing
+func (con *Connection) Received() uint64 {
+	con.delivery.mu.Lock()
+	defer con.delivery.mu.Unlock()
+	return con.delivery.received
+}
+
+// acknowledges every message received so far, unless that has been done already
+func (con *Connection) ack(ws *websocket.Conn) {
+	con.delivery.mu.Lock()
+	seq := con.delivery.received
+	if seq == con.delivery.acked {
+		con.delivery.mu.Unlock()
+		return
+	}
+	con.delivery.acked = seq
+	con.delivery.mu.Unlock()
+
+	msgjson, err := json.Marshal(WorkerMessage{Type: ACK, Ack: seq})
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	if _, err := ws.Write(msgjson); err != nil {
+		logger.Debug("ack(%d): %v", seq, err)
+	}
+}
+
+// acknowledges received messages every second until the connection is closed, usually started in NewConnection
+func (con *Connection) AckMsgs() {
+	ticker := time.NewTicker(time.Duration(1) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			con.ack(con.GetSocket())
+		case <-con.closed:
+			return
+		}
+	}
+}
+
+// matches this end's sequence numbers to those of the other end after a reconnect. the other end's session and the
+// last message it received are given, the messages it is missing are returned for replay. a new session means the
+// other end restarted, then nothing is replayed and both directions start over
+func (con *Connection) Resync(peer string, received uint64) [][]byte {
+	con.delivery.mu.Lock()
+	defer con.delivery.mu.Unlock()
+	if peer != con.delivery.peer {
+		logger.Debug("Resync(): new session %v, dropping %d unacknowledged messages", peer, len(con.delivery.unacked))
+		for range con.delivery.unacked {
+			<-con.window
+		}
+		con.delivery = delivery{peer: peer}
+		return nil
+	}
+
+	n := 0
+	for n < len(con.delivery.unacked) && con.delivery.unacked[n].seq <= received {
+		n++
+	}
+	for i := 0; i < n; i++ {
+		<-con.window
+	}
+	con.delivery.unacked = con.delivery.unacked[n:]
+	replay := make([][]byte, 0, len(con.delivery.unacked))
+	for _, u := range con.delivery.unacked {
+		replay = append(replay, u.msgjson)
+	}
+	return replay
+}
+
+// writes the messages the other end is missing to a new socket, returns false if it died meanwhile
+func Replay(ws *websocket.Conn, replay [][]byte) bool {
+	if len(replay) > 0 {
+		logger.Printf("replaying %d unacknowledged messages", len(replay))
+	}
+	for _, msgjson := range replay {
+		if _, err := ws.Write(msgjson); err != nil {
+			logger.Warn(err)
+			return false
+		}
+	}
+	return true
+}
+
+// agrees the protocol of a worker's first connection, before any numbered message from the master is read
+func (con *Connection) welcomed(msg WorkerMessage) {
+	welcome, err := NewWelcomeMsgBody(msg.Body)
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	con.Resync(welcome.Session, welcome.Received)
+	con.SetProtocol(*welcome)
+}
+
+// takes over the socket of a worker that reconnected to the master: tells the worker what has been received, replays
+// what the worker hasn't, and swaps in the socket. returns true if the death of the old one was sent on DiedChan
+func (con *Connection) Resume(ws *websocket.Conn, hello *HelloMsgBody, welcome WelcomeMsgBody) (died bool) {
+	<-con.sending
+	defer func() { con.sending <- 1 }()
+
+	con.SetProtocol(welcome)
+	replay := con.Resync(hello.Session, hello.Received)
+	if hello.ProtocolVersion >= 2 {
+		welcome.Received = con.Received()
+		if err := SendWelcome(ws, welcome, nil); err != nil {
+			logger.Warn(err)
+		}
+	}
+	if con.Allows(ACK) {
+		Replay(ws, replay)
+	}
+	return con.Replace(ws)
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// a message after a gap is dropped unacknowledged and the socket closed, so the reconnect replays what was lost
+func TestReceiveGap(t *testing.T) {
+	closed := make(chan error, 1)
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var frame []byte
+		closed <- websocket.Message.Receive(ws, &frame)
+	}))
+	defer server.Close()
+	ws, err := websocket.Dial("ws://"+server.Listener.Addr().String()+"/", "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	con := &Connection{Socket: ws, window: make(chan int, maxunacked), closed: make(chan int)}
+	if con.receive(ws, 1) == false {
+		t.Fatal("message 1 wasn't received")
+	}
+	if con.receive(ws, 3) {
+		t.Fatal("message 3 was received after a gap")
+	}
+	if received := con.Received(); received != 1 {
+		t.Fatalf("received %d after a gap, expected 1", received)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("the socket wasn't closed after a gap")
+	}
+	if con.receive(ws, 2) == false || con.receive(ws, 3) == false {
+		t.Fatal("replayed messages weren't received")
+	}
+	if received := con.Received(); received != 3 {
+		t.Fatalf("received %d after the replay, expected 3", received)
+	}
+}
+
+func TestAckMsgsStopsOnClose(t *testing.T) {
+	con := &Connection{closed: make(chan int)}
+	stopped := make(chan int)
+	go func() {
+		con.AckMsgs()
+		close(stopped)
+	}()
+	con.Close()
+	con.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("AckMsgs didn't stop when the connection was closed")
+	}
+}
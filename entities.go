@@ -21,6 +21,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -41,8 +42,32 @@ type TaskHolder struct {
 }
 
 type Task struct {
-	Count int
-	Args  []string
+	Count      int
+	Args       []string
+	Dir        string   // optional working directory
+	Inputs     []string // files under the master's stage directory to download before the task starts
+	Outputs    []string // glob patterns (relative to the task directory) to upload after the task ends
+	OutputMode string   // "lines" (the default) or "raw" to keep output byte for byte
+	Executor   string   // "direct" (the default), "shell" or a wrapper executor configured on the workers
+	IdMode     string   // "args" (the default), "env" or "placeholders", see IdArgs
+}
+
+// checks the parts of a task that can be checked before it reaches a worker
+func (this Task) Validate() error {
+	if len(this.Args) == 0 {
+		return fmt.Errorf("task has no Args")
+	}
+	switch this.OutputMode {
+	case "", LINEOUTPUT, RAWOUTPUT:
+	default:
+		return fmt.Errorf("unknown OutputMode %q", this.OutputMode)
+	}
+	switch this.IdMode {
+	case "", IDARGS, IDENV, IDPLACEHOLDERS:
+	default:
+		return fmt.Errorf("unknown IdMode %q", this.IdMode)
+	}
+	return nil
 }
 
 type JobDetails struct {
@@ -58,10 +83,40 @@ type JobDetails struct {
 
 	Progress TaskProgress
 
+	Attribution string // tags prefixed to each line of output, see ParseAttribution
+	OutputFiles string // MERGEDFILES or SPLITFILES
+	Compression string // of the output and log files, see ValidCompression
+
+	OutputLimits   OutputLimits
+	Overage        OutputOverage // output dropped for passing the task or job limits
+	TruncatedTasks int           // tasks whose output passed their limits
+
+	OutputSink    string // name of the sink the job's files are written to, see GetOutputSink
+	OutputDir     string // where the master writes the job's files
+	OutputUri     string // OutputDir as the master serves it under /output/, ending in a slash
+	OutputSubpath string // requested by the job, under the directory named by the master's outputname
+
+	BundleHash string // sha256 of the scripts or tarball submitted with the job
+	BundleName string
+
+	Finalizer *Task // run once after every task has finished or errored, its outcome decides Status
+
+	ResultsSaved bool // set in the scribe's store once the results of the completed job are copied from the master
+
+	LogFormat string // JSONLOG or TEXTLOG
+
 	State  string // job state
 	Status string // job status
 }
 
+// suffix of the job's log file
+func (this JobDetails) LogSuffix() string {
+	if this.LogFormat == TEXTLOG {
+		return ".log.txt"
+	}
+	return ".log.jsonl"
+}
+
 func (this JobDetails) IsRunning() bool {
 	return this.State == RUNNING
 }
@@ -109,28 +164,44 @@ func TotalTasks(tasks []Task) (totalTasks int) {
 	return
 }
 
-// workers
+// workers. the values are part of the protocol between masters and workers that may be running different versions,
+// so types are never renumbered or reused and new ones are added at the end with a capability, see messageCapabilities
 const (
-	HELLO   = iota //sent from worker to master on connect, body is number of processes available
-	CHECKIN        //sent from worker every minute to keep connection alive
+	HELLO   = 0 //sent from worker to master on connect, body is json HelloMsgBody
+	CHECKIN = 1 //sent from worker every minute to keep connection alive
+
+	START = 2 //sent from master to start job, body is json job
+	KILL  = 3 //sent from master to stop jobs, SubId indicates what jobs to stop.
 
-	START //sent from master to start job, body is json job
-	KILL  //sent from master to stop jobs, SubId indicates what jobs to stop.
+	COUT   = 4 //standard out line (or raw chunk) from worker
+	CERROR = 5 //standard err line (or raw chunk) from worker
 
-	COUT   //standard out line from worker
-	CERROR //standard err line from worker
+	JOBFINISHED = 6 //sent from worker on job finish, body is json job SubId set
+	JOBERROR    = 7 //sent from worker on job error, body is json job, SubId set
 
-	JOBFINISHED //sent from worker on job finish, body is json job SubId set
-	JOBERROR    //sent from worker on job error, body is json job, SubId set
+	RESTART = 8 //Sent by master to nodes telling them to restart and reconnect themselves.
+	DIE     = 9 //tell nodes to shutdown.
 
-	RESTART //Sent by master to nodes telling them to restart and reconnect themselves.
-	DIE     //tell nodes to shutdown.
+	CLEANUP  = 10 //sent from master when a job completes so workers can remove its bundle, SubId set
+	CAPACITY = 11 //sent from worker when the number of tasks it will take changes, body is number of processes available
+	RESULT   = 12 //sent from worker with a JSON record a task wrote to its result channel, body is the record, LineId, JobId and Attempt set
+
+	TASKSTARTED = 13 //sent from worker once a task's process has started, body is json job, SubId set
+	WELCOME     = 14 //sent from master in reply to the HELLO of a worker speaking protocol version 2 or later, body is json WelcomeMsgBody, ErrMsg set if the worker is refused
+	ACK         = 15 //sent from either end to acknowledge every numbered message up to Ack, written as messages arrive rather than queued
 )
 
 type HelloMsgBody struct {
 	JobCapacity int
 	RunningJobs int
 	UniqueId    string
+	PathMap     PathMap
+	Tasks       []WorkerJob // tasks still running when a worker reconnects
+
+	ProtocolVersion int      // 0 from workers speaking the original protocol
+	Capabilities    []string // optional message types the worker handles
+	Session         string   // changes when the worker restarts
+	Received        uint64   // the last numbered message the worker received from the master
 }
 
 func NewHelloMsgBody(data string) (*HelloMsgBody, error) {
@@ -151,14 +222,19 @@ type WorkerNode struct {
 	MaxJobs     int
 	RunningJobs int
 	Running     bool
+	PathMap     PathMap
+	Protocol    WelcomeMsgBody // protocol version and capabilities agreed with the worker
+	Metrics     NodeMetrics    // from the latest check-in
+	History     []NodeMetrics  // recent check-ins, only included for a single node
 }
 
 func NewWorkerNode(nh *NodeHandle) WorkerNode {
 	logger.Debug("NewWorkerNode()")
 	maxJobs, running := nh.Stats()
+	metrics, _ := nh.LatestMetrics()
 	logger.Debug("creating new worker: %d,%d", maxJobs, running)
 	return WorkerNode{NodeId: nh.NodeId, Uri: nh.Uri, Hostname: nh.Hostname,
-		MaxJobs: maxJobs, RunningJobs: running, Running: (running > 0)}
+		MaxJobs: maxJobs, RunningJobs: running, Running: (running > 0), PathMap: nh.PathMap, Protocol: nh.Con.Protocol(), Metrics: metrics}
 }
 
 type WorkerMessage struct {
@@ -166,6 +242,21 @@ type WorkerMessage struct {
 	SubId  string
 	Body   string
 	ErrMsg string
+
+	LineId  int // task that produced COUT, CERROR and RESULT messages
+	JobId   int
+	Attempt int
+	Chunk   *OutputChunk // raw output of tasks using RAWOUTPUT, Body is empty
+
+	Overage  *OutputOverage // output a task finishing with JOBFINISHED or JOBERROR wrote past its limits
+	Exit     *TaskExit      // how the task's process ended, with JOBFINISHED and JOBERROR once it has started
+	Counts   *OutputCounts  // COUT and CERROR messages the task sent, with JOBFINISHED and JOBERROR once it has started
+	Returned bool           // with JOBERROR, the task wasn't started and should be sent to another worker
+
+	MsgSeq uint64 // numbers messages between ends that acknowledge them, 0 otherwise
+	Ack    uint64 // the last numbered message received, with ACK
+
+	flushed chan int // internal marker closed by Connection.SendMsgs, never sent
 }
 
 func (wm *WorkerMessage) BodyFromInterface(Body interface{}) error {
@@ -181,10 +272,31 @@ func (wm *WorkerMessage) BodyFromInterface(Body interface{}) error {
 
 //Internal Job Representation used primarily as the body of job related messages
 type WorkerJob struct {
-	SubId  string
-	LineId int
-	JobId  int
-	Args   []string
+	SubId   string
+	LineId  int
+	JobId   int
+	Args    []string
+	Dir     string
+	Inputs  []string
+	Outputs []string
+
+	BundleHash  string
+	BundleName  string
+	OutputMode  string
+	Attribution string
+	Executor    string
+	IdMode      string
+
+	OutputLimits OutputLimits
+
+	Env []string // NAME=value variables set for the task besides those of TaskEnv
+
+	Attempt int // number of earlier attempts lost with the worker running them
+}
+
+// identifies a task within the cluster independently of the attempt running it
+func (job *WorkerJob) Key() string {
+	return fmt.Sprintf("%v/%d/%d", job.SubId, job.LineId, job.JobId)
 }
 
 type SubmitedWorkerJob struct {
@@ -215,6 +327,26 @@ type ClusterStat struct {
 	WorkersAvailable int
 }
 
+// a snapshot of a single worker node taken by the scribe
+type NodeStat struct {
+	SnapshotAt  int64
+	NodeId      string
+	Hostname    string
+	MaxJobs     int
+	RunningJobs int
+	Metrics     NodeMetrics
+}
+
+type NodeStatList struct {
+	Items         []NodeStat
+	NumberOfItems int
+}
+
+func NewNodeStat(wn WorkerNode) NodeStat {
+	return NodeStat{SnapshotAt: time.Now().UnixNano(), NodeId: wn.NodeId, Hostname: wn.Hostname,
+		MaxJobs: wn.MaxJobs, RunningJobs: wn.RunningJobs, Metrics: wn.Metrics}
+}
+
 func NewClusterStat(running int, pending int, workers int, available int) ClusterStat {
 	return ClusterStat{SnapshotAt: time.Now().UnixNano(),
 		JobsRunning: running, JobsPending: pending,
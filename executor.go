@@ -0,0 +1,136 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// turns the arguments of a task into the command that runs it, ids are the arguments identifying the task
+type Executor interface {
+	Command(args []string, ids []string) (*exec.Cmd, error)
+}
+
+// runs the task's executable directly, the default
+type DirectExecutor struct{}
+
+func (this DirectExecutor) Command(args []string, ids []string) (*exec.Cmd, error) {
+	//make sure the path to the exec is fully qualified
+	exepath, err := exec.LookPath(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(exepath, append(append([]string{}, args[1:]...), ids...)...), nil
+}
+
+// runs the task's arguments, joined with spaces, as a shell command. ids are available to it as $1, $2 and $3 rather
+// than appended as they are for the other executors: a command line may be a pipeline or a list, and ids appended to
+// it would only reach its last command
+type ShellExecutor struct {
+	Shell string
+}
+
+func (this ShellExecutor) Command(args []string, ids []string) (*exec.Cmd, error) {
+	shargs := append([]string{"-c", strings.Join(args, " "), "golem"}, ids...)
+	return exec.Command(this.Shell, shargs...), nil
+}
+
+// runs every task through a launcher such as "nice -n 19" or a container runtime, the task's executable is resolved by the launcher
+type WrapperExecutor struct {
+	Launcher []string
+}
+
+// parses a launcher command line, arguments are separated by whitespace
+func NewWrapperExecutor(launcher string) (*WrapperExecutor, error) {
+	fields := strings.Fields(launcher)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty launcher")
+	}
+	return &WrapperExecutor{Launcher: fields}, nil
+}
+
+func (this WrapperExecutor) Command(args []string, ids []string) (*exec.Cmd, error) {
+	exepath, err := exec.LookPath(this.Launcher[0])
+	if err != nil {
+		return nil, err
+	}
+	wrapped := append(append(append([]string{}, this.Launcher[1:]...), args...), ids...)
+	return exec.Command(exepath, wrapped...), nil
+}
+
+// finds the executor a task asked for, tasks that don't name one are run directly
+func GetExecutor(name string) (Executor, error) {
+	if name == "" {
+		name = "direct"
+	}
+	executor, isin := executors[name]
+	if !isin {
+		return nil, fmt.Errorf("unknown executor %q", name)
+	}
+	return executor, nil
+}
+
+// ways a task can be given the ids of the job, line and task it runs
+const (
+	IDARGS         = "args"         // appended as the last three arguments, the default
+	IDENV          = "env"          // only in the environment
+	IDPLACEHOLDERS = "placeholders" // substituted for {GOLEM_SUB_ID} and the like in the task's arguments
+)
+
+// environment variables holding the task's ids, they are set whichever IdMode the task uses
+func TaskEnv(job *WorkerJob) []string {
+	env := []string{
+		"GOLEM_SUB_ID=" + job.SubId,
+		"GOLEM_LINE_ID=" + strconv.Itoa(job.LineId),
+		"GOLEM_TASK_ID=" + strconv.Itoa(job.JobId),
+		"GOLEM_ATTEMPT=" + strconv.Itoa(job.Attempt),
+	}
+	return append(env, job.Env...)
+}
+
+// replaces {GOLEM_SUB_ID}, {GOLEM_LINE_ID}, {GOLEM_TASK_ID} and {GOLEM_ATTEMPT} in each argument
+func SubstituteIds(args []string, job *WorkerJob) []string {
+	pairs := []string{}
+	for _, kv := range TaskEnv(job) {
+		nv := strings.SplitN(kv, "=", 2)
+		pairs = append(pairs, "{"+nv[0]+"}", nv[1])
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	substituted := make([]string, len(args))
+	for i, arg := range args {
+		substituted[i] = replacer.Replace(arg)
+	}
+	return substituted
+}
+
+// the arguments appended to the task's command for its IdMode
+func IdArgs(job *WorkerJob) ([]string, error) {
+	switch job.IdMode {
+	case "", IDARGS:
+		return []string{job.SubId, strconv.Itoa(job.LineId), strconv.Itoa(job.JobId)}, nil
+	case IDENV, IDPLACEHOLDERS:
+		return []string{}, nil
+	}
+	return nil, fmt.Errorf("unknown IdMode %q", job.IdMode)
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testIds = []string{"A1B2C3", "2", "7"}
+
+func TestDirectExecutorAppendsIds(t *testing.T) {
+	cmd, err := DirectExecutor{}.Command([]string{"echo", "-n"}, testIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "A1B2C3 2 7" {
+		t.Fatalf("output %q", out)
+	}
+}
+
+// a shell command gets the ids as $1, $2 and $3, not appended where they would reach only the end of a pipeline
+func TestShellExecutorIds(t *testing.T) {
+	shell := ShellExecutor{"/bin/sh"}
+	for _, test := range []struct {
+		command string
+		output  string
+	}{
+		{`echo "$1/$2/$3"`, "A1B2C3/2/7\n"},
+		{`printf 'b\na\n' | sort`, "a\nb\n"},
+	} {
+		cmd, err := shell.Command([]string{test.command}, testIds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%v: %v", test.command, err)
+		}
+		if string(out) != test.output {
+			t.Fatalf("%v: output %q, expected %q", test.command, out, test.output)
+		}
+	}
+}
+
+func TestIdArgs(t *testing.T) {
+	job := &WorkerJob{SubId: "A1B2C3", LineId: 2, JobId: 7}
+	for mode, expected := range map[string][]string{"": testIds, IDARGS: testIds, IDENV: {}, IDPLACEHOLDERS: {}} {
+		job.IdMode = mode
+		ids, err := IdArgs(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Fatalf("IdMode %q: ids %v, expected %v", mode, ids, expected)
+		}
+	}
+	job.IdMode = "flags"
+	if _, err := IdArgs(job); err == nil {
+		t.Fatal("unknown IdMode accepted")
+	}
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// bytes of recent output kept in memory for each stream of a running job
+const feedhistory = 1 << 20
+
+// the stdout or stderr of a job as the master receives it, with its recent history kept for tailing
+type OutputFeed struct {
+	mu        sync.Mutex
+	history   []byte
+	start     int64 // offset in the stream of history[0]
+	followers map[chan []byte]bool
+	closed    bool
+}
+
+func NewOutputFeed() *OutputFeed {
+	return &OutputFeed{followers: map[chan []byte]bool{}}
+}
+
+// adds output to the history and passes it to followers, a follower too slow to keep up is dropped
+func (f *OutputFeed) Publish(text string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.history = append(f.history, text...)
+	if len(f.history) > 2*feedhistory {
+		trim := len(f.history) - feedhistory
+		f.history = append([]byte(nil), f.history[trim:]...)
+		f.start += int64(trim)
+	}
+
+	for ch := range f.followers {
+		select {
+		case ch <- []byte(text):
+		default:
+			logger.Printf("Publish(): dropping a follower that fell behind")
+			delete(f.followers, ch)
+			close(ch)
+		}
+	}
+}
+
+// returns the output kept from offset on, or its last tail lines if tail is positive, and the offset it starts at.
+// with follow, and unless the stream has ended, output published afterwards is sent on the returned channel,
+// which is closed at the end of the stream
+func (f *OutputFeed) Read(offset int64, tail int, follow bool) ([]byte, int64, chan []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	from := f.start
+	data := f.history
+	if tail > 0 {
+		data = LastLines(data, tail)
+		from = f.start + int64(len(f.history)-len(data))
+	} else if offset > f.start {
+		skip := offset - f.start
+		if skip > int64(len(data)) {
+			skip = int64(len(data))
+		}
+		data = data[skip:]
+		from += skip
+	}
+	data = append([]byte(nil), data...)
+
+	if !follow || f.closed {
+		return data, from, nil
+	}
+	ch := make(chan []byte, iobuffersize)
+	f.followers[ch] = true
+	return data, from, ch
+}
+
+// stops sending output to a follower that went away
+func (f *OutputFeed) Unfollow(ch chan []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.followers[ch] {
+		delete(f.followers, ch)
+		close(ch)
+	}
+}
+
+// ends the stream once the job is done
+func (f *OutputFeed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for ch := range f.followers {
+		delete(f.followers, ch)
+		close(ch)
+	}
+}
+
+// the end of data holding its last n lines, a final line without a newline counts as a line
+func LastLines(data []byte, n int) []byte {
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := 0; i < n; i++ {
+		nl := bytes.LastIndexByte(data[:end], '\n')
+		if nl < 0 {
+			return data
+		}
+		end = nl
+	}
+	return data[end+1:]
+}
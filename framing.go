@@ -0,0 +1,168 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go.net/websocket"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+)
+
+// frames holding several messages start with one of these bytes instead of the '{' of a single json message,
+// followed by each message's length as 4 big endian bytes and its json
+const (
+	BATCHFRAME     = 1
+	GZIPBATCHFRAME = 2 // the lengths and messages are gzip compressed
+	ZSTDBATCHFRAME = 3 // the lengths and messages are zstd compressed
+)
+
+// most messages sent in one frame, kept well below maxunacked
+const batchmessages = 1000
+
+// batches smaller than this are sent uncompressed
+const compressbytes = 1024
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// bytes of output a message carries, used to size batches
+func (msg *WorkerMessage) size() int {
+	n := len(msg.Body)
+	if msg.Chunk != nil {
+		n += len(msg.Chunk.Data)
+	}
+	return n
+}
+
+// true for the messages a worker sends many of, which may wait up to batchmillis to be sent with others
+func Batchable(msgType int) bool {
+	switch msgType {
+	case COUT, CERROR, RESULT:
+		return true
+	}
+	return false
+}
+
+// puts json messages in one frame, a single message is sent as it is so any end can read it
+func EncodeFrame(msgjsons [][]byte, compression string) ([]byte, error) {
+	if len(msgjsons) == 1 {
+		return msgjsons[0], nil
+	}
+
+	frame := &bytes.Buffer{}
+	frame.WriteByte(BATCHFRAME)
+	prefix := make([]byte, 4)
+	for _, msgjson := range msgjsons {
+		binary.BigEndian.PutUint32(prefix, uint32(len(msgjson)))
+		frame.Write(prefix)
+		frame.Write(msgjson)
+	}
+	if frame.Len() < compressbytes {
+		return frame.Bytes(), nil
+	}
+
+	body := frame.Bytes()[1:]
+	switch compression {
+	case GZIPCOMPRESSION:
+		compressed := &bytes.Buffer{}
+		compressed.WriteByte(GZIPBATCHFRAME)
+		zw, err := gzip.NewWriterLevel(compressed, gzip.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return compressed.Bytes(), nil
+	case ZSTDCOMPRESSION:
+		return zstdEncoder.EncodeAll(body, []byte{ZSTDBATCHFRAME}), nil
+	}
+	return frame.Bytes(), nil
+}
+
+// the messages in a frame, those read before an error are returned with it
+func DecodeFrame(frame []byte) ([]WorkerMessage, error) {
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("empty frame")
+	}
+	if frame[0] == '{' {
+		msg := WorkerMessage{}
+		if err := json.Unmarshal(frame, &msg); err != nil {
+			return nil, err
+		}
+		return []WorkerMessage{msg}, nil
+	}
+
+	body := frame[1:]
+	var err error
+	switch frame[0] {
+	case BATCHFRAME:
+	case GZIPBATCHFRAME:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = ioutil.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	case ZSTDBATCHFRAME:
+		if body, err = zstdDecoder.DecodeAll(body, nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown frame type %d", frame[0])
+	}
+
+	msgs := []WorkerMessage{}
+	for len(body) > 0 {
+		if len(body) < 4 {
+			return msgs, fmt.Errorf("truncated frame")
+		}
+		n := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		if uint32(len(body)) < n {
+			return msgs, fmt.Errorf("truncated frame")
+		}
+		msg := WorkerMessage{}
+		if err := json.Unmarshal(body[:n], &msg); err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+		body = body[n:]
+	}
+	return msgs, nil
+}
+
+// writes a single json message as a text frame and batches as binary frames
+func WriteFrame(ws *websocket.Conn, frame []byte) error {
+	if frame[0] == '{' {
+		_, err := ws.Write(frame)
+		return err
+	}
+	return websocket.Message.Send(ws, frame)
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var benchline = "chr1\t1048576\trs12345\tA\tG\t99.5\tPASS\tDP=42;AF=0.5;MQ=60\tGT:AD:DP\t0/1:21,21:42"
+
+func benchmsg(i int) []byte {
+	msgjson, err := json.Marshal(WorkerMessage{Type: COUT, SubId: "bench", JobId: i, Body: benchline})
+	if err != nil {
+		panic(err)
+	}
+	return msgjson
+}
+
+// sends b.N output messages over a web socket to a local server and reports how many per second get through
+func benchmarkSocket(b *testing.B, send func(ws *websocket.Conn, n int) error, receive func(ws *websocket.Conn, n int) error) {
+	received := make(chan error, 1)
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		received <- receive(ws, b.N)
+	}))
+	defer server.Close()
+	ws, err := websocket.Dial("ws://"+server.Listener.Addr().String()+"/", "", "http://localhost/")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ws.Close()
+
+	b.ResetTimer()
+	start := time.Now()
+	sent := make(chan error, 1)
+	go func() { sent <- send(ws, b.N) }()
+	if err := <-sent; err != nil {
+		b.Fatal(err)
+	}
+	if err := <-received; err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msgs/s")
+}
+
+// one json text frame per message read with a json.Decoder, as SendMsgs and ReadMsg did before batching
+func BenchmarkFramingPerMessage(b *testing.B) {
+	benchmarkSocket(b, func(ws *websocket.Conn, n int) error {
+		for i := 0; i < n; i++ {
+			if _, err := ws.Write(benchmsg(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(ws *websocket.Conn, n int) error {
+		for i := 0; i < n; i++ {
+			msg := WorkerMessage{}
+			if err := json.NewDecoder(ws).Decode(&msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// messages batched as SendMsgs does for an end with the batch capability, read with DecodeFrame as GetMsgs does
+func benchmarkBatches(b *testing.B, compression string) {
+	benchmarkSocket(b, func(ws *websocket.Conn, n int) error {
+		msgjsons := [][]byte{}
+		size := 0
+		for i := 0; i < n; i++ {
+			msgjson := benchmsg(i)
+			msgjsons = append(msgjsons, msgjson)
+			size += len(msgjson)
+			if len(msgjsons) < batchmessages && size < batchbytes && i < n-1 {
+				continue
+			}
+			frame, err := EncodeFrame(msgjsons, compression)
+			if err != nil {
+				return err
+			}
+			if err := WriteFrame(ws, frame); err != nil {
+				return err
+			}
+			msgjsons, size = msgjsons[:0], 0
+		}
+		return nil
+	}, func(ws *websocket.Conn, n int) error {
+		for received := 0; received < n; {
+			var frame []byte
+			if err := websocket.Message.Receive(ws, &frame); err != nil {
+				return err
+			}
+			msgs, err := DecodeFrame(frame)
+			if err != nil {
+				return err
+			}
+			received += len(msgs)
+		}
+		return nil
+	})
+}
+
+func BenchmarkFramingBatch(b *testing.B) {
+	benchmarkBatches(b, NOCOMPRESSION)
+}
+
+func BenchmarkFramingBatchGzip(b *testing.B) {
+	benchmarkBatches(b, GZIPCOMPRESSION)
+}
+
+func BenchmarkFramingBatchZstd(b *testing.B) {
+	benchmarkBatches(b, ZSTDCOMPRESSION)
+}
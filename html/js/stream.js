@@ -129,6 +129,42 @@ function transition() {
      });
 }
 
+var outputRequest = null;
+
+function followOutput() {
+    if (outputRequest) {
+        outputRequest.abort();
+    }
+    var jobId = Ext.getDom("outputjobid").value;
+    var stream = Ext.getDom("outputstream").value;
+    var tail = parseInt(Ext.getDom("outputtail").value);
+    var outputDiv = Ext.getDom("output");
+    outputDiv.innerHTML = "";
+
+    var url = "/jobs/" + jobId + "/" + stream + "/follow";
+    if (tail > 0) {
+        url = "/jobs/" + jobId + "/" + stream + "/tail/" + tail + "/follow";
+    }
+
+    var request = new XMLHttpRequest();
+    var seen = 0;
+    request.onreadystatechange = function() {
+        if (request.readyState < 3) {
+            return;
+        }
+        if (request.status != 200) {
+            outputDiv.textContent = request.status + " " + request.responseText;
+            return;
+        }
+        outputDiv.appendChild(document.createTextNode(request.responseText.substring(seen)));
+        seen = request.responseText.length;
+        outputDiv.scrollTop = outputDiv.scrollHeight;
+    };
+    request.open("GET", url, true);
+    request.send(null);
+    outputRequest = request;
+}
+
 function drawChart(vis,data,mx,color1,color2) {
     if (data && data.length) {
         var color = d3.interpolateRgb(color1,color2);
@@ -0,0 +1,80 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// seconds between capacity checks on an opportunistic worker
+const idlecheckseconds = 10
+
+// decides how many tasks an opportunistic worker should take given the other load on its machine
+type IdleMonitor struct {
+	processes int // the configured maximum
+}
+
+func NewIdleMonitor(processes int) *IdleMonitor {
+	return &IdleMonitor{processes: processes}
+}
+
+// no tasks while an interactive user is active, otherwise one task fewer for each unit of load not caused by golem
+func (this *IdleMonitor) Capacity(running int) int {
+	if UserActive(time.Duration(idleseconds) * time.Second) {
+		logger.Debug("Capacity(): interactive user active")
+		return 0
+	}
+
+	la, err := LoadAverage()
+	if err != nil {
+		logger.Warn(err)
+		return this.processes
+	}
+
+	otherload := la[0] - float64(running) - idleload
+	if otherload <= 0 {
+		return this.processes
+	}
+	capacity := this.processes - int(math.Ceil(otherload))
+	if capacity < 0 {
+		capacity = 0
+	}
+	logger.Debug("Capacity(): load %v, running %d, capacity %d", la[0], running, capacity)
+	return capacity
+}
+
+// true if any terminal has seen input within the given duration
+func UserActive(within time.Duration) bool {
+	ttys, _ := filepath.Glob("/dev/pts/[0-9]*")
+	consoles, _ := filepath.Glob("/dev/tty[0-9]*")
+	for _, tty := range append(ttys, consoles...) {
+		fi, err := os.Stat(tty)
+		if err != nil {
+			continue
+		}
+		if time.Since(LastInput(fi)) < within {
+			return true
+		}
+	}
+	return false
+}
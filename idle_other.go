@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// without access times the last write to the terminal is the best estimate of activity
+func LastInput(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
+
+// runs a process at the lowest cpu priority, io priority is left unchanged
+func LowerPriority(pid int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, 19)
+}
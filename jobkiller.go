@@ -38,9 +38,18 @@ func (k *Killable) Kill() {
 	logger.Printf("kill results: %v: %v", k.Pid, errno)
 }
 
+// sends a signal to the job's process group (jobs are started in their own group)
+func (k *Killable) Signal(sig syscall.Signal) {
+	logger.Printf("signal process group: %v: %v", k.Pid, sig)
+	if err := syscall.Kill(-k.Pid, sig); err != nil {
+		logger.Warn(err)
+	}
+}
+
 //A job killer is created to monitor and kill jobs
 type JobKiller struct {
-	Killchan     chan string    //used to send in the SubId of jobs to kill
+	Killchan     chan string         //used to send in the SubId of jobs to kill
+	Signalchan   chan syscall.Signal //used to send a signal to every registered job
 	Donechan     chan *Killable //used to indicate that a job is done and should no longer be killable
 	Registerchan chan *Killable //used to register a job as a killable
 
@@ -49,7 +58,7 @@ type JobKiller struct {
 
 //creates a Job Killer and starts its routine KillJobs
 func NewJobKiller() (jk *JobKiller) {
-	jk = &JobKiller{Killchan: make(chan string, 3), Donechan: make(chan *Killable, 3), Registerchan: make(chan *Killable, 3), killables: map[string]*Killable{}}
+	jk = &JobKiller{Killchan: make(chan string, 3), Signalchan: make(chan syscall.Signal, 1), Donechan: make(chan *Killable, 3), Registerchan: make(chan *Killable, 3), killables: map[string]*Killable{}}
 	go jk.KillJobs()
 	return
 }
@@ -66,6 +75,10 @@ func (jk *JobKiller) KillJobs() {
 				}
 			}
 			logger.Debug("done killing: %v", SubId)
+		case sig := <-jk.Signalchan:
+			for _, kb := range jk.killables {
+				kb.Signal(sig)
+			}
 		case kb := <-jk.Registerchan:
 			logger.Debug("registering: %v", kb)
 			jk.killables[fmt.Sprintf("%v%v", kb.SubId, kb.JobId)] = kb
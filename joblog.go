@@ -0,0 +1,191 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// formats of the job log
+const (
+	JSONLOG = "json" // one LogEvent per line in jobid.log.jsonl, the default
+	TEXTLOG = "text" // the original "FINISHED subid taskid lineid args" lines in jobid.log.txt
+)
+
+// events in the job log
+const (
+	SUBMITTEDEVENT  = "submitted"  // task sent to a worker
+	STARTEDEVENT    = "started"    // task's process started on the worker
+	FINISHEDEVENT   = "finished"   // task ended successfully
+	ERROREDEVENT    = "errored"    // task failed, couldn't be started or was lost with its worker too often
+	KILLEDEVENT     = "killed"     // task's process was killed by a signal
+	RETRIEDEVENT    = "retried"    // task lost with its worker was submitted again
+	FINALIZINGEVENT = "finalizing" // every task has ended and the job's finalizer was submitted
+	COMPLETEDEVENT  = "completed"  // job complete, Status set
+)
+
+func ValidLogFormat(value string) error {
+	switch value {
+	case JSONLOG, TEXTLOG:
+		return nil
+	}
+	return fmt.Errorf("invalid job log format %q (expected %v or %v)", value, JSONLOG, TEXTLOG)
+}
+
+// how a task's process ended, sent by the worker with JOBFINISHED and JOBERROR
+type TaskExit struct {
+	Code    int     // exit status, -1 if the process was killed by a signal
+	Signal  string  // signal that killed the process
+	Seconds float64 // how long the process ran
+}
+
+func NewTaskExit(state *os.ProcessState, ran time.Duration) *TaskExit {
+	if state == nil {
+		return nil
+	}
+	exit := &TaskExit{Code: -1, Seconds: ran.Seconds()}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok {
+		if ws.Signaled() {
+			exit.Signal = ws.Signal().String()
+		} else {
+			exit.Code = ws.ExitStatus()
+		}
+	}
+	return exit
+}
+
+// a task reported finished or errored by a worker, or errored by the master
+type EndedWorkerJob struct {
+	wj     *WorkerJob
+	host   string
+	exit   *TaskExit
+	errmsg string
+	counts *OutputCounts
+}
+
+// an entry of the job log
+type LogEvent struct {
+	Time      string // RFC 3339, UTC
+	Event     string
+	SubId     string
+	LineId    int
+	TaskId    int
+	Attempt   int
+	Finalizer bool // the event is about the job's finalizer
+	Host      string
+	Args      []string
+	ExitCode  *int
+	Signal    string
+	Seconds   float64 // how long the task's process ran
+	Error     string
+	Status    string // of the job once it is complete
+}
+
+func NewLogEvent(event string, wj *WorkerJob) LogEvent {
+	e := LogEvent{Time: time.Now().UTC().Format(time.RFC3339Nano), Event: event}
+	if wj != nil {
+		e.SubId, e.LineId, e.TaskId, e.Attempt, e.Args = wj.SubId, wj.LineId, wj.JobId, wj.Attempt, wj.Args
+	}
+	return e
+}
+
+// the event logged when a worker reports a task has ended
+func NewEndedEvent(ewj *EndedWorkerJob, failed bool) LogEvent {
+	event := FINISHEDEVENT
+	if failed {
+		event = ERROREDEVENT
+	}
+	if ewj.exit != nil && ewj.exit.Signal != "" {
+		event = KILLEDEVENT
+	}
+	e := NewLogEvent(event, ewj.wj)
+	e.Host = ewj.host
+	e.Error = ewj.errmsg
+	if ewj.exit != nil {
+		if ewj.exit.Signal == "" {
+			code := ewj.exit.Code
+			e.ExitCode = &code
+		}
+		e.Signal = ewj.exit.Signal
+		e.Seconds = ewj.exit.Seconds
+	}
+	return e
+}
+
+// writes the events of a job to its log in one of the log formats
+type JobLog struct {
+	file   io.WriteCloser
+	format string
+}
+
+func NewJobLog(file io.WriteCloser, format string) *JobLog {
+	return &JobLog{file: file, format: format}
+}
+
+func (this *JobLog) Log(e LogEvent) {
+	var err error
+	if this.format == TEXTLOG {
+		err = this.LogText(e)
+	} else {
+		var line []byte
+		if line, err = json.Marshal(e); err == nil {
+			_, err = this.file.Write(append(line, '\n'))
+		}
+	}
+	if err != nil {
+		logger.Warn(err)
+	}
+	FlushOutput(this.file)
+}
+
+// writes the lines of the original text log, events it didn't have are left out
+func (this *JobLog) LogText(e LogEvent) (err error) {
+	args := strings.Join(e.Args, " ")
+	event := strings.ToUpper(e.Event)
+	switch e.Event {
+	case SUBMITTEDEVENT:
+		_, err = fmt.Fprintf(this.file, "SUBMITTED to %v %v %v %v %v\n", e.Host, e.SubId, e.TaskId, e.LineId, args)
+	case RETRIEDEVENT:
+		_, err = fmt.Fprintf(this.file, "RETRIED %v %v %v %v %v\n", e.Attempt, e.SubId, e.TaskId, e.LineId, args)
+	case FINISHEDEVENT, ERROREDEVENT, KILLEDEVENT:
+		if e.Event == KILLEDEVENT {
+			event = "ERRORED"
+		}
+		if e.Finalizer {
+			event = "FINALIZER " + event
+		}
+		_, err = fmt.Fprintf(this.file, "%v %v %v %v %v\n", event, e.SubId, e.TaskId, e.LineId, args)
+	case FINALIZINGEVENT:
+		_, err = fmt.Fprintf(this.file, "FINALIZING %v %v %v %v\n", e.SubId, e.TaskId, e.LineId, args)
+	case COMPLETEDEVENT:
+		_, err = fmt.Fprintln(this.file, "COMPLETED")
+	}
+	return
+}
+
+func (this *JobLog) Close() error {
+	return this.file.Close()
+}
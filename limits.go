@@ -0,0 +1,180 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// limits on the output of each task and of a whole job, applied to stdout and stderr separately. zero is unlimited
+type OutputLimits struct {
+	TaskBytes int64
+	TaskLines int64
+	JobBytes  int64
+	JobLines  int64
+	Kill      bool // kill a task that passes its limits
+}
+
+// parses a comma separated list such as "taskbytes=10485760,tasklines=100000,jobbytes=1073741824,joblines=0,kill"
+func ParseOutputLimits(value string) (l OutputLimits, err error) {
+	for _, option := range strings.Split(value, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if option == "kill" {
+			l.Kill = true
+			continue
+		}
+		namevalue := strings.SplitN(option, "=", 2)
+		var limit int64
+		if len(namevalue) == 2 {
+			limit, err = strconv.ParseInt(strings.TrimSpace(namevalue[1]), 10, 64)
+		}
+		if len(namevalue) != 2 || err != nil || limit < 0 {
+			err = fmt.Errorf("invalid output limit %q (expected taskbytes, tasklines, jobbytes or joblines=count, or kill)", option)
+			return
+		}
+		switch strings.TrimSpace(namevalue[0]) {
+		case "taskbytes":
+			l.TaskBytes = limit
+		case "tasklines":
+			l.TaskLines = limit
+		case "jobbytes":
+			l.JobBytes = limit
+		case "joblines":
+			l.JobLines = limit
+		default:
+			err = fmt.Errorf("invalid output limit %q (expected taskbytes, tasklines, jobbytes or joblines=count, or kill)", option)
+			return
+		}
+	}
+	return
+}
+
+// formats the limits as ParseOutputLimits expects them, unlimited values are left out
+func (l OutputLimits) String() string {
+	options := []string{}
+	for _, limit := range []struct {
+		name  string
+		value int64
+	}{{"taskbytes", l.TaskBytes}, {"tasklines", l.TaskLines}, {"jobbytes", l.JobBytes}, {"joblines", l.JobLines}} {
+		if limit.value > 0 {
+			options = append(options, fmt.Sprintf("%v=%d", limit.name, limit.value))
+		}
+	}
+	if l.Kill {
+		options = append(options, "kill")
+	}
+	return strings.Join(options, ",")
+}
+
+// lines (or, for raw output, chunks) a task sent on each stream, so the master can tell when all of it has arrived
+type OutputCounts struct {
+	Stdout int
+	Stderr int
+}
+
+// output that passed a limit and was dropped
+type OutputOverage struct {
+	StdoutBytes int64
+	StdoutLines int64
+	StderrBytes int64
+	StderrLines int64
+}
+
+func (o *OutputOverage) Add(other OutputOverage) {
+	o.StdoutBytes += other.StdoutBytes
+	o.StdoutLines += other.StdoutLines
+	o.StderrBytes += other.StderrBytes
+	o.StderrLines += other.StderrLines
+}
+
+// the name of the stream a COUT or CERROR message belongs to
+func StreamName(msgType int) string {
+	if msgType == CERROR {
+		return "stderr"
+	}
+	return "stdout"
+}
+
+// counts the output written to one stream and cuts it off once it passes maxBytes or maxLines
+type OutputLimiter struct {
+	maxBytes     int64
+	maxLines     int64
+	Bytes        int64 // passed on
+	Lines        int64
+	DroppedBytes int64
+	DroppedLines int64
+	Exceeded     chan int // closed when output is first dropped
+}
+
+func NewOutputLimiter(maxBytes int64, maxLines int64) *OutputLimiter {
+	return &OutputLimiter{maxBytes: maxBytes, maxLines: maxLines, Exceeded: make(chan int)}
+}
+
+func (l *OutputLimiter) Truncated() bool {
+	return l.DroppedBytes > 0
+}
+
+// returns the part of text within the limits. the first time output is cut it is followed by a marker naming
+// what was truncated, afterwards everything is dropped
+func (l *OutputLimiter) Limit(text string, what string) string {
+	n := len(text)
+	if l.Truncated() {
+		n = 0
+	}
+	if l.maxBytes > 0 && l.Bytes+int64(n) > l.maxBytes {
+		n = int(l.maxBytes - l.Bytes)
+	}
+	if l.maxLines > 0 {
+		lines := l.Lines
+		for i := 0; i < n; i++ {
+			if lines >= l.maxLines {
+				n = i
+				break
+			}
+			if text[i] == '\n' {
+				lines++
+			}
+		}
+	}
+
+	l.Bytes += int64(n)
+	l.Lines += int64(strings.Count(text[:n], "\n"))
+	if n == len(text) {
+		return text
+	}
+
+	first := !l.Truncated()
+	l.DroppedBytes += int64(len(text) - n)
+	l.DroppedLines += int64(strings.Count(text[n:], "\n"))
+	if !first {
+		return text[:n]
+	}
+	close(l.Exceeded)
+	kept := text[:n]
+	if kept != "" && !strings.HasSuffix(kept, "\n") {
+		kept += "\n"
+	}
+	return kept + fmt.Sprintf("[golem: %v truncated after %d bytes and %d lines]\n", what, l.Bytes, l.Lines)
+}
@@ -27,27 +27,34 @@ import (
 	"labix.org/v1/mgo"
 	"net/http"
 	"net/url"
-	"os"
+	"runtime"
 )
 
 var logger *log4go.VerboseLogger
 
-//parse args and start as master, scribe, addama proxy or worker
+//parse args and start as master, scribe, addama proxy, worker or a master with local workers
 func main() {
 	var configurationFile string
 	var isMaster bool
 	var isScribe bool
 	var isAddama bool
+	var isLocal bool
 
 	flag.BoolVar(&isMaster, "m", false, "Start as master node.")
 	flag.BoolVar(&isScribe, "s", false, "Start as scribe node.")
 	flag.BoolVar(&isAddama, "a", false, "Start as addama node.")
+	flag.BoolVar(&isLocal, "local", false, "Start as master node running tasks in its own process.")
 	flag.StringVar(&configurationFile, "config", "golem.config", "A configuration file for golem services")
 	flag.Parse()
 
+	configpath = configurationFile
 	configFile, err := goconf.ReadConfigFile(configurationFile)
 	if err != nil {
-		panic(err)
+		if !isLocal {
+			panic(err)
+		}
+		//local mode runs with the defaults when there is no configuration
+		configFile = goconf.NewConfigFile()
 	}
 
 	GlobalLogger(configFile)
@@ -55,9 +62,13 @@ func main() {
 	SubIOBufferSize("default", configFile)
 	GoMaxProc("default", configFile)
 	ConBufferSize("default", configFile)
+	FrameConfig("default", configFile)
+	OutputConfig(configFile)
 	StartHtmlHandler(configFile)
 
-	if isMaster {
+	if isLocal {
+		StartLocal(configFile)
+	} else if isMaster {
 		StartMaster(configFile)
 	} else if isScribe {
 		StartScribe(configFile)
@@ -82,23 +93,80 @@ func GlobalLogger(configFile *goconf.ConfigFile) {
 
 // starts master service based on the given configuration file
 // required parameters:  default.hostname, default.password
-// optional parameters:  master.buffersize
+// optional parameters:  master.buffersize, master.stagedir, master.stagemaxbytes, master.reconnectseconds, master.maxattempts
 func StartMaster(configFile *goconf.ConfigFile) {
 	SubIOBufferSize("master", configFile)
 	GoMaxProc("master", configFile)
 	ConBufferSize("master", configFile)
+	FrameConfig("master", configFile)
 	IOMOnitors(configFile)
+	StageConfig("master", configFile)
+	ReconnectConfig(configFile)
+	CompressionConfig(configFile)
+	JobLogConfig(configFile)
+	ProtocolConfig(configFile)
+	OutputLimitsConfig(configFile)
+	OutputSinkConfig(configFile)
 
 	hostname := GetRequiredString(configFile, "default", "hostname")
 	password := GetRequiredString(configFile, "default", "password")
 
+	ServeMaster(password)
+
+	ListenAndServeTLSorNot(hostname)
+}
+
+// creates the master and registers its REST API
+func ServeMaster(password string) *Master {
 	m := NewMaster()
+	http.Handle("/stage/", StageController{m, password})
 
 	rest.Resource("jobs", MasterJobController{m, password})
 	rest.Resource("nodes", MasterNodeController{m, password})
 
 	rest.ResourceContentType("jobs", "application/json")
 	rest.ResourceContentType("nodes", "application/json")
+	return m
+}
+
+// starts a master with the REST API of a cluster that runs tasks in its own process, for laptops and testing.
+// no config file, certificate or worker processes are needed
+// optional parameters:  local.hostname (default localhost:8083), local.processes (default the number of cpus), local.tls (default false),
+// default.password and the master and worker parameters other than worker.masterhost
+func StartLocal(configFile *goconf.ConfigFile) {
+	SubIOBufferSize("master", configFile)
+	IOMOnitors(configFile)
+	StageConfig("master", configFile)
+	StageConfig("worker", configFile)
+	ReconnectConfig(configFile)
+	CompressionConfig(configFile)
+	JobLogConfig(configFile)
+	ProtocolConfig(configFile)
+	OutputLimitsConfig(configFile)
+	OutputSinkConfig(configFile)
+	PathMapConfig(configFile)
+	CheckInSeconds(configFile)
+	OpportunisticConfig(configFile)
+	DrainSeconds(configFile)
+	NodeIdFile(configFile)
+	ExecutorConfig(configFile)
+
+	hostname, err := configFile.GetString("local", "hostname")
+	if err != nil {
+		hostname = "localhost:8083"
+	}
+	processes, err := configFile.GetInt("local", "processes")
+	if err != nil || processes < 1 {
+		processes = runtime.NumCPU()
+	}
+	if useTls, err = configFile.GetBool("local", "tls"); err != nil {
+		useTls = false
+	}
+	password, _ := configFile.GetString("default", "password")
+	logger.Printf("StartLocal() [%v, %d, tls=%v]", hostname, processes, useTls)
+
+	m := ServeMaster(password)
+	go m.RunLocalWorker(processes, hostname, password)
 
 	ListenAndServeTLSorNot(hostname)
 }
@@ -178,19 +246,31 @@ func StartAddama(configFile *goconf.ConfigFile) {
 
 // starts worker based on the given configuration file
 // required parameters:  worker.masterhost
-// optional parameters:  worker.processes
+// optional parameters:  worker.processes, worker.pathmap, worker.checkinseconds, worker.opportunistic, worker.drainseconds, worker.nodeidfile, executors.*, default.password (used to stage task files)
 func StartWorker(configFile *goconf.ConfigFile) {
 
 	GoMaxProc("worker", configFile)
 	ConBufferSize("worker", configFile)
+	FrameConfig("worker", configFile)
+	StageConfig("worker", configFile)
+	PathMapConfig(configFile)
+	CheckInSeconds(configFile)
+	OpportunisticConfig(configFile)
+	DrainSeconds(configFile)
+	NodeIdFile(configFile)
+	ExecutorConfig(configFile)
 	processes, err := configFile.GetInt("worker", "processes")
 	if err != nil {
 		logger.Warn(err)
 		processes = 3
 	}
+	apikey, err := configFile.GetString("default", "password")
+	if err != nil {
+		logger.Warn(err)
+	}
 	masterhost := GetRequiredString(configFile, "worker", "masterhost")
 	logger.Printf("StartWorker() [%v, %d]", masterhost, processes)
-	RunNode(processes, masterhost)
+	RunNode(processes, masterhost, apikey)
 }
 
 // starts http handlers for HTML content based on the given configuration file
@@ -200,9 +280,6 @@ func StartHtmlHandler(configFile *goconf.ConfigFile) {
 		logger.Printf("StartHtmlHandler(): serving HTML content from [%v]", contentDir)
 		http.Handle("/html/", http.StripPrefix("/html/", http.FileServer(http.Dir(contentDir))))
 		http.Handle("/", http.RedirectHandler("/html/index.html", http.StatusTemporaryRedirect))
-		wd, err := os.Getwd()
-		if err == nil {
-			http.Handle("/output/", http.StripPrefix("/output/", http.FileServer(http.Dir(wd))))
-		}
+		http.Handle("/output/", http.StripPrefix("/output/", NewOutputFileServer(outputroot)))
 	}
 }
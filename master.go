@@ -21,8 +21,10 @@ package main
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"fmt"
 	"net/http"
 	"sync"
+	"time"
 )
 
 type Master struct {
@@ -30,6 +32,7 @@ type Master struct {
 	subMap      map[string]*Submission //buffered channel for creating jobs TODO: verify thread safety... should be okay since we only set once
 	jobChan     chan *WorkerJob        //buffered channel for creating jobs
 	subidChan   chan int               //buffered channel used to keep track of submissions
+	archived    map[string]string      //output directories of jobs archived out of subMap, by job id
 	nodeMu      sync.RWMutex
 	NodeHandles map[string]*NodeHandle
 }
@@ -38,6 +41,7 @@ type Master struct {
 func NewMaster() *Master {
 	m := &Master{
 		subMap:      map[string]*Submission{},
+		archived:    map[string]string{},
 		jobChan:     make(chan *WorkerJob, 0),
 		NodeHandles: map[string]*NodeHandle{}}
 	http.Handle("/master/", websocket.Handler(func(ws *websocket.Conn) { m.Listen(ws) }))
@@ -51,40 +55,205 @@ func (m *Master) GetSub(subId string) *Submission {
 	return m.subMap[subId]
 }
 
+// directory the job's files are in, kept for archived jobs. jobs the master never knew are looked for directly in outputroot
+func (m *Master) OutputDir(subId string) string {
+	if s := m.GetSub(subId); s != nil {
+		return s.SniffDetails().OutputDir
+	}
+	m.subMu.RLock()
+	defer m.subMu.RUnlock()
+	if dir, isin := m.archived[subId]; isin {
+		return dir
+	}
+	return outputroot
+}
+
 func (m *Master) Listen(ws *websocket.Conn) {
 	logger.Printf("Listen(%v): node connecting", ws.LocalAddr().String())
-	nh := NewNodeHandle(NewConnection(ws, false), m)
-	logger.Printf("Adding Node to Map (%v)", ws.LocalAddr().String())
+	msg, err := ReadMsg(ws)
+	if err != nil || msg.Type != HELLO {
+		logger.Printf("%v didn't say hello as first message.", ws.LocalAddr().String())
+		return
+	}
+	logger.Printf("Node Hello Body:%v", msg.Body)
+	hello, err := NewHelloMsgBody(msg.Body)
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+
+	welcome, err := NegotiateProtocol(hello)
+	if err != nil {
+		logger.Printf("refusing node %v (%v): %v", hello.UniqueId, ws.RemoteAddr().String(), err)
+		if hello.ProtocolVersion >= 2 {
+			SendWelcome(ws, welcome, err)
+		}
+		ws.Close()
+		return
+	}
+	logger.Printf("node %v speaks protocol version %d with %v", hello.UniqueId, welcome.ProtocolVersion, welcome.Capabilities)
+
+	nh, err := m.Reattach(ws, hello, welcome)
+	if err != nil {
+		logger.Printf("refusing node %v (%v): %v", hello.UniqueId, ws.RemoteAddr().String(), err)
+		if hello.ProtocolVersion >= 2 {
+			SendWelcome(ws, welcome, err)
+		}
+		ws.Close()
+		return
+	}
+	if nh != nil {
+		logger.Printf("Node %v reconnected (%v)", nh.NodeId, ws.LocalAddr().String())
+		nh.Con.GetMsgs(ws)
+		return
+	}
+
+	con := NewConnection(ws, false)
+	con.Resync(hello.Session, 0)
+	con.SetProtocol(welcome)
+	if hello.ProtocolVersion >= 2 {
+		if err := SendWelcome(ws, welcome, nil); err != nil {
+			logger.Warn(err)
+			return
+		}
+	}
+	m.AddNode(NewNodeHandle(con, m, hello, ws.RemoteAddr().String()))
+}
+
+// adds a node to the map and hands it jobs until it is removed
+func (m *Master) AddNode(nh *NodeHandle) {
+	logger.Printf("Adding Node to Map (%v)", nh.Hostname)
 	m.nodeMu.Lock()
 	m.NodeHandles[nh.NodeId] = nh
 	m.nodeMu.Unlock()
-	logger.Printf("Calling Remove Node on Death (%v)", ws.LocalAddr().String())
-	go m.RemoveNodeOnDeath(nh)
 
+	logger.Printf("Calling Remove Node on Death (%v)", nh.Hostname)
+	go m.RemoveNodeOnDeath(nh)
 	for i := 0; i < iomonitors; i++ {
-		logger.Printf("Starting IOMonitor %v (%v)", i, ws.LocalAddr().String())
+		logger.Printf("Starting IOMonitor %v (%v)", i, nh.Hostname)
 		go nh.MonitorIO()
 	}
-	logger.Printf("Starting Monitor (%v)", ws.LocalAddr().String())
+
+	logger.Printf("Starting Monitor (%v)", nh.Hostname)
 	nh.Monitor()
 }
 
-// sends a message to every connected worker
+// starts a worker with the given number of processes in this process, it talks to the master over channels
+// and stages files through the master's listener at hostname
+func (m *Master) RunLocalWorker(processes int, hostname string, apikey string) {
+	logger.Debug("RunLocalWorker(%d)", processes)
+	mcon, wcon := NewLocalConnections()
+	go RunWorker(wcon, processes, hostname, apikey)
+
+	msg := <-mcon.InChan
+	hello, err := NewHelloMsgBody(msg.Body)
+	if err != nil || msg.Type != HELLO {
+		logger.Printf("local worker didn't say hello as first message: %v", err)
+		return
+	}
+	welcome := mcon.Protocol()
+	reply := WorkerMessage{Type: WELCOME}
+	reply.BodyFromInterface(welcome)
+	mcon.OutChan <- reply
+	m.AddNode(NewNodeHandle(mcon, m, hello, "local"))
+}
+
+// hands the socket of a reconnecting worker to the node handle that already has its id, returns nil if there is none.
+// a different worker process using the id of a connected worker is refused. the handle is only looked up under nodeMu,
+// replaying what the worker missed doesn't hold up other nodes
+func (m *Master) Reattach(ws *websocket.Conn, hello *HelloMsgBody, welcome WelcomeMsgBody) (*NodeHandle, error) {
+	if hello.UniqueId == "" {
+		return nil, nil
+	}
+	m.nodeMu.Lock()
+	nh, isin := m.NodeHandles[hello.UniqueId]
+	if !isin {
+		m.nodeMu.Unlock()
+		return nil, nil
+	}
+	if nh.Con.Connected() && hello.Session != nh.Con.Peer() {
+		m.nodeMu.Unlock()
+		return nil, fmt.Errorf("node id %v is in use by the connected worker at %v; give each worker its own nodeidfile", hello.UniqueId, nh.Hostname)
+	}
+	select {
+	case nh.resuming <- 1:
+	default:
+		m.nodeMu.Unlock()
+		return nil, fmt.Errorf("node id %v is already reconnecting", hello.UniqueId)
+	}
+	m.nodeMu.Unlock()
+	defer func() { <-nh.resuming }()
+
+	if nh.Con.Connected() {
+		logger.Printf("node %v reconnected before its old socket was seen to die", hello.UniqueId)
+	}
+	nh.Reconcile(hello)
+	if nh.Con.Resume(ws, hello, welcome) {
+		select {
+		case nh.Reattached <- 1:
+		default:
+		}
+	}
+	return nh, nil
+}
+
+// sends a message to every connected worker without waiting for any of them to take it
 func (m *Master) Broadcast(msg *WorkerMessage) {
 	m.nodeMu.RLock()
 	logger.Debug("Broadcast(%v): to %v nodes", *msg, len(m.NodeHandles))
 	for _, nh := range m.NodeHandles {
-		nh.BroadcastChan <- msg
+		//a node that is busy or stuck doesn't hold up the others, or anything waiting on nodeMu
+		go func(nh *NodeHandle) {
+			select {
+			case nh.BroadcastChan <- msg:
+			case <-nh.stop:
+			}
+		}(nh)
 	}
 	m.nodeMu.RUnlock()
 	logger.Debug("Broadcast(): done")
 }
 
-// remove node handles from the map used to store them as they disconnect
+// tells workers to remove the job's bundle once all of its tasks are done
+func (m *Master) CleanupOnCompletion(s *Submission, subId string) {
+	logger.Debug("CleanupOnCompletion(%v)", subId)
+	<-s.Completed
+	m.Broadcast(&WorkerMessage{Type: CLEANUP, SubId: subId})
+}
+
+// remove node handles from the map used to store them as they disconnect and don't reconnect within reconnectseconds,
+// tasks still outstanding on them are resubmitted
 func (m *Master) RemoveNodeOnDeath(nh *NodeHandle) {
 	logger.Debug("RemoveNodeOnDeath(%v)", nh.NodeId)
-	<-nh.Con.DiedChan
-	m.nodeMu.Lock()
-	delete(m.NodeHandles, nh.NodeId)
-	m.nodeMu.Unlock()
+	for {
+		<-nh.Con.DiedChan
+		logger.Printf("node %v disconnected, waiting %d seconds for it to reconnect", nh.NodeId, reconnectseconds)
+		select {
+		case <-nh.Reattached:
+			continue
+		case <-time.After(time.Duration(reconnectseconds) * time.Second):
+		}
+
+		m.nodeMu.Lock()
+		//a reattach holding resuming has taken over the dead socket and signals Reattached before letting go
+		if len(nh.resuming) > 0 {
+			m.nodeMu.Unlock()
+			<-nh.Reattached
+			continue
+		}
+		select {
+		case <-nh.Reattached:
+			m.nodeMu.Unlock()
+			continue
+		default:
+		}
+		delete(m.NodeHandles, nh.NodeId)
+		m.nodeMu.Unlock()
+		break
+	}
+
+	logger.Printf("node %v removed", nh.NodeId)
+	nh.Con.Close()
+	close(nh.stop)
+	nh.LoseTasks(nh.Outstanding(), 0)
 }
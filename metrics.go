@@ -0,0 +1,129 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// number of check-ins kept by the master for each node
+const metricshistory = 60
+
+// load and health of a worker, sent as the body of CHECKIN messages
+type NodeMetrics struct {
+	At           int64 // unix nanoseconds
+	LoadAverage  [3]float64
+	FreeMemory   uint64 // bytes
+	FreeScratch  uint64 // bytes free in the worker's scratch directory
+	RunningTasks int
+}
+
+func NewNodeMetrics(data string) (*NodeMetrics, error) {
+	rv := &NodeMetrics{}
+	err := json.Unmarshal([]byte(data), rv)
+	return rv, err
+}
+
+// gathers the current metrics of this machine, values that can't be read are left as zero
+func CollectNodeMetrics(running int) NodeMetrics {
+	m := NodeMetrics{At: time.Now().UnixNano(), RunningTasks: running}
+	var err error
+	if m.LoadAverage, err = LoadAverage(); err != nil {
+		logger.Debug("CollectNodeMetrics(): %v", err)
+	}
+	if m.FreeMemory, err = FreeMemory(); err != nil {
+		logger.Debug("CollectNodeMetrics(): %v", err)
+	}
+	if m.FreeScratch, err = FreeDisk(scratchdir); err != nil {
+		logger.Debug("CollectNodeMetrics(): %v", err)
+	}
+	return m
+}
+
+// reads the 1, 5 and 15 minute load averages from /proc/loadavg
+func LoadAverage() (la [3]float64, err error) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		err = errors.New("unexpected /proc/loadavg format")
+		return
+	}
+	for i := 0; i < 3; i++ {
+		if la[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// reads the memory available to new processes from /proc/meminfo
+func FreeMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = kb * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if available, isin := values["MemAvailable"]; isin {
+		return available, nil
+	}
+	if free, isin := values["MemFree"]; isin {
+		return free + values["Buffers"] + values["Cached"], nil
+	}
+	return 0, errors.New("unexpected /proc/meminfo format")
+}
+
+// bytes available to unprivileged users on the filesystem holding dir
+func FreeDisk(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, fmt.Errorf("statfs %v: %v", dir, err)
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
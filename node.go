@@ -23,14 +23,20 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"os/exec"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-func PipeToChan(r io.Reader, msgType int, id string, ch chan WorkerMessage, done chan int, prepend string) {
+func PipeToChan(r io.Reader, msgType int, job *WorkerJob, attr Attribution, limiter *OutputLimiter, ch chan WorkerMessage, done chan int, prepend string) {
+	id := job.SubId
 	logger.Debug("PipeToChan(%d,%v)", msgType, id)
 	bp := bufio.NewReader(r)
+	sent := 0
 	for {
 
 		line, prefix, err := bp.ReadLine()
@@ -40,12 +46,17 @@ func PipeToChan(r io.Reader, msgType int, id string, ch chan WorkerMessage, done
 			linestr = linestr + string(line)
 		}
 
+		//output past the task's limits is still read so the task isn't blocked writing it
+		if linestr != "" {
+			linestr = limiter.Limit(linestr+"\n", "task "+StreamName(msgType))
+		}
 		if linestr != "" {
 			blocked := true
 			for blocked == true {
 				select {
-				case ch <- WorkerMessage{Type: msgType, SubId: id, Body: prepend + linestr + "\n"}:
+				case ch <- WorkerMessage{Type: msgType, SubId: id, LineId: job.LineId, JobId: job.JobId, Attempt: job.Attempt, Body: prepend + attr.Prefix(job) + linestr}:
 					blocked = false
+					sent++
 				case <-time.After(time.Second):
 					logger.Printf("WARNING PipeToChan() has been blocked for more then 1 second MsgType:%d,id:%v", msgType, id)
 				}
@@ -54,62 +65,166 @@ func PipeToChan(r io.Reader, msgType int, id string, ch chan WorkerMessage, done
 		}
 		switch {
 		case err == io.EOF:
-			done <- 1
+			done <- sent
 			return
 		case err != nil:
-			done <- 1
+			done <- sent
 			logger.Warn(err)
 			return
 		}
 	}
-	done <- 1
-
 }
 
-func StartJob(cn *Connection, replyc chan *WorkerMessage, jsonjob string, jk *JobKiller) {
+func StartJob(cn *Connection, replyc chan *WorkerMessage, jsonjob string, jk *JobKiller, stager *Stager, bundles *BundleCache) {
 	logger.Debug("StartJob(%v)", jsonjob)
-	con := *cn
+	con := cn
 
 	job := NewWorkerJob(jsonjob)
-	jobcmd := job.Args[0]
-	//make sure the path to the exec is fully qualified
-	exepath, err := exec.LookPath(jobcmd)
+
+	bundledir := ""
+	if job.BundleHash != "" {
+		dir, err := bundles.Get(job)
+		if err != nil {
+			con.OutChan <- WorkerMessage{Type: CERROR, SubId: job.SubId, Body: fmt.Sprintf("Error fetching bundle %s: %s\n", job.BundleName, err)}
+			replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
+			return
+		}
+		bundledir = dir
+	}
+
+	//tasks with staged files run in their own scratch directory
+	taskdir := ""
+	if len(job.Inputs) > 0 || len(job.Outputs) > 0 {
+		taskdir = TaskDir(job)
+		defer os.RemoveAll(taskdir)
+		if err := stager.StageIn(job, taskdir); err != nil {
+			con.OutChan <- WorkerMessage{Type: CERROR, SubId: job.SubId, Body: fmt.Sprintf("Error staging inputs: %s\n", err)}
+			logger.Warn(err)
+			replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
+			return
+		}
+	}
+
+	//workers may mount shared paths at different locations
+	job.Args = pathmap.RewriteArgs(job.Args)
+	job.Dir = pathmap.Rewrite(job.Dir)
+	//a finalizer is given the paths of the job's files on the master as NAME=path
+	job.Env = pathmap.RewriteArgs(job.Env)
+
+	args := append([]string{}, job.Args...)
+	//executables shipped in the job's bundle are run from it
+	if bundledir != "" && !filepath.IsAbs(args[0]) {
+		if _, err := os.Stat(filepath.Join(bundledir, args[0])); err == nil {
+			args[0] = filepath.Join(bundledir, args[0])
+		}
+	}
+	if job.IdMode == IDPLACEHOLDERS {
+		args = SubstituteIds(args, job)
+	}
+
+	ids, err := IdArgs(job)
+	var executor Executor
+	if err == nil {
+		executor, err = GetExecutor(job.Executor)
+	}
+	if err != nil {
+		con.OutChan <- WorkerMessage{Type: CERROR, SubId: job.SubId, Body: fmt.Sprintf("Error running %s: %s\n", args[0], err)}
+		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
+		return
+	}
+	//start the job in test dir pass all stdio back to main.
+	cmd, err := executor.Command(args, ids)
 	if err != nil {
-		con.OutChan <- WorkerMessage{Type: CERROR, SubId: job.SubId, Body: fmt.Sprintf("Error finding %s: %s\n", jobcmd, err)}
-		logger.Printf("exec %s: %s\n", jobcmd, err)
-		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob}
+		con.OutChan <- WorkerMessage{Type: CERROR, SubId: job.SubId, Body: fmt.Sprintf("Error finding %s: %s\n", args[0], err)}
+		logger.Printf("exec %s: %s\n", args[0], err)
+		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
 		return
 	}
+	//own process group so a ctrl-c aimed at the worker doesn't reach tasks before they are drained
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Dir = job.Dir
+	if taskdir != "" {
+		cmd.Dir = taskdir
+	}
+	cmd.Env = append(os.Environ(), TaskEnv(job)...)
+	if bundledir != "" {
+		if cmd.Dir == "" {
+			cmd.Dir = bundledir
+		}
+		cmd.Env = append(cmd.Env, "GOLEM_BUNDLE_DIR="+bundledir)
+	}
+
+	//an invalid attribution is refused by the master, so at worst a hostname lookup failed
+	attr, err := ParseAttribution(job.Attribution)
+	if err != nil {
+		logger.Warn(err)
+	}
 
-	args := job.Args[1:]
-	args = append(args, fmt.Sprintf("%v", job.SubId))
-	args = append(args, fmt.Sprintf("%v", job.LineId))
-	args = append(args, fmt.Sprintf("%v", job.JobId))
+	outlimiter := NewOutputLimiter(job.OutputLimits.TaskBytes, job.OutputLimits.TaskLines)
+	errlimiter := NewOutputLimiter(job.OutputLimits.TaskBytes, job.OutputLimits.TaskLines)
 
-	//start the job in test dir pass all stdio back to main.  note that cmd has to be the first thing in the args array
-	cmd := exec.Command(exepath, args...)
+	//open every pipe before any goroutine reads one, so a failure leaves none of them waiting on a task that never starts
+	//tasks write JSON records, one per line, to file descriptor 3
+	resultr, resultw, err := os.Pipe()
+	if err != nil {
+		logger.Warn(err)
+		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
+		return
+	}
+	defer resultr.Close()
+	cmd.ExtraFiles = []*os.File{resultw}
+	cmd.Env = append(cmd.Env, "GOLEM_RESULT=/dev/fd/3")
 
 	outpipe, err := cmd.StdoutPipe()
 	if err != nil {
 		logger.Warn(err)
+		resultw.Close()
+		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
 		return
 	}
-	coutchan := make(chan int, 0)
-	go PipeToChan(outpipe, COUT, job.SubId, con.OutChan, coutchan, "")
-
 	errpipe, err := cmd.StderrPipe()
 	if err != nil {
 		logger.Warn(err)
+		resultw.Close()
+		outpipe.Close()
+		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
 		return
 	}
+
+	coutchan := make(chan int, 0)
+	if job.OutputMode == RAWOUTPUT {
+		go PipeChunksToChan(outpipe, COUT, job, outlimiter, con.OutChan, coutchan)
+	} else {
+		go PipeToChan(outpipe, COUT, job, attr, outlimiter, con.OutChan, coutchan, "")
+	}
 	cerrorchan := make(chan int, 0)
-	go PipeToChan(errpipe, CERROR, job.SubId, con.OutChan, cerrorchan, "TASK : \""+exepath+strings.Join(args, " ")+"\" ERRORED: \n")
+	if job.OutputMode == RAWOUTPUT {
+		go PipeChunksToChan(errpipe, CERROR, job, errlimiter, con.OutChan, cerrorchan)
+	} else {
+		go PipeToChan(errpipe, CERROR, job, attr, errlimiter, con.OutChan, cerrorchan, "TASK : \""+strings.Join(cmd.Args, " ")+"\" ERRORED: \n")
+	}
+	resultchan := make(chan int, 1)
+	go PipeResultsToChan(resultr, job, con.OutChan, resultchan)
 
-	if err = cmd.Start(); err != nil {
+	err = cmd.Start()
+	resultw.Close()
+	if err != nil {
 		logger.Warn(err)
+		//a failed start closes the pipes, let their readers finish
+		<-coutchan
+		<-cerrorchan
+		<-resultchan
 		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
 		return
 	}
+	started := time.Now()
+	con.OutChan <- WorkerMessage{Type: TASKSTARTED, SubId: job.SubId, Body: jsonjob}
+
+	if opportunistic {
+		if err := LowerPriority(cmd.Process.Pid); err != nil {
+			logger.Warn(err)
+		}
+	}
 
 	kb := &Killable{Pid: cmd.Process.Pid, SubId: job.SubId, JobId: job.JobId}
 	jk.Registerchan <- kb
@@ -117,62 +232,180 @@ func StartJob(cn *Connection, replyc chan *WorkerMessage, jsonjob string, jk *Jo
 		jk.Donechan <- kb
 	}()
 
-	<-coutchan
-	<-cerrorchan
-	if err = cmd.Wait(); err != nil {
+	limitkilled := make(chan int)
+	if job.OutputLimits.Kill {
+		exited := make(chan int)
+		defer close(exited)
+		go func() {
+			select {
+			case <-outlimiter.Exceeded:
+			case <-errlimiter.Exceeded:
+			case <-exited:
+				return
+			}
+			logger.Printf("killing task %v, it passed its output limits", job.Key())
+			close(limitkilled)
+			kb.Signal(syscall.SIGKILL)
+		}()
+	}
+
+	counts := &OutputCounts{Stdout: <-coutchan, Stderr: <-cerrorchan}
+	<-resultchan
+	err = cmd.Wait()
+	exit := NewTaskExit(cmd.ProcessState, time.Since(started))
+	overage := &OutputOverage{StdoutBytes: outlimiter.DroppedBytes, StdoutLines: outlimiter.DroppedLines, StderrBytes: errlimiter.DroppedBytes, StderrLines: errlimiter.DroppedLines}
+	if !outlimiter.Truncated() && !errlimiter.Truncated() {
+		overage = nil
+	}
+	if taskdir != "" {
+		if stageErr := stager.StageOut(job, taskdir); stageErr != nil {
+			con.OutChan <- WorkerMessage{Type: CERROR, SubId: job.SubId, Body: fmt.Sprintf("Error staging outputs: %s\n", stageErr)}
+			if err == nil {
+				err = stageErr
+			}
+		}
+	}
+	if err != nil {
 		logger.Warn(err)
-		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: err.Error()}
+		errmsg := err.Error()
+		select {
+		case <-limitkilled:
+			errmsg = "killed for passing its output limits: " + errmsg
+		default:
+		}
+		replyc <- &WorkerMessage{Type: JOBERROR, SubId: job.SubId, Body: jsonjob, ErrMsg: errmsg, Overage: overage, Exit: exit, Counts: counts}
 		return
 	}
 
 	logger.Printf("finishing job %v", job.JobId)
-	replyc <- &WorkerMessage{Type: JOBFINISHED, SubId: job.SubId, Body: jsonjob}
+	replyc <- &WorkerMessage{Type: JOBFINISHED, SubId: job.SubId, Body: jsonjob, Overage: overage, Exit: exit, Counts: counts}
 }
 
-func CheckIn(c *Connection) {
-	logger.Debug("CheckIn(%v)", c.isWorker)
-	con := *c
-	for {
-		<-time.After(time.Duration(60) * time.Second)
-		logger.Debug("CheckIn(%v) after sleep", c.isWorker)
-		con.OutChan <- WorkerMessage{Type: CHECKIN}
+// builds the periodic check-in that keeps the connection alive and reports this worker's load
+func CheckIn(running int) WorkerMessage {
+	logger.Debug("CheckIn(%d)", running)
+	wm := WorkerMessage{Type: CHECKIN}
+	wm.BodyFromInterface(CollectNodeMetrics(running))
+	return wm
+}
+
+func RunningTasks(tasks map[string]*WorkerJob) []WorkerJob {
+	rv := make([]WorkerJob, 0, len(tasks))
+	for _, job := range tasks {
+		rv = append(rv, *job)
+	}
+	return rv
+}
+
+// connects to the master and runs tasks it sends
+func RunNode(processes int, master string, apikey string) {
+	RunWorker(NewConnection(OpenWebSocketToMaster(master), true), processes, master, apikey)
+}
+
+// hands a task sent while draining back to the master, returns false for a master that doesn't know capacity
+// messages and so can't give the task to another worker, it still gets the task run
+func HandBack(mcon *Connection, msg WorkerMessage) bool {
+	if !mcon.Allows(CAPACITY) {
+		return false
 	}
+	logger.Printf("draining: handing the task back")
+	mcon.OutChan <- WorkerMessage{Type: JOBERROR, SubId: msg.SubId, Body: msg.Body, ErrMsg: "the worker is draining", Returned: true}
+	return true
 }
 
-func RunNode(processes int, master string) {
+// runs tasks sent over mcon, files are staged through the master's listener
+func RunWorker(mcon *Connection, processes int, master string, apikey string) {
 	running := 0
 
+	//opportunistic workers advertise fewer processes while the machine is in use
+	capacity := processes
+	idle := NewIdleMonitor(processes)
+	var idlechecks <-chan time.Time
+	if opportunistic {
+		capacity = idle.Capacity(running)
+		idlechecks = time.Tick(time.Duration(idlecheckseconds) * time.Second)
+	}
+
 	jk := NewJobKiller()
+	stager := NewStager(master, apikey)
+	bundles := NewBundleCache(stager)
 	logger.Debug("Running as %d process node owned by %v", processes, master)
 
-	ws := OpenWebSocketToMaster(master)
+	//tasks are tracked so a reconnecting worker can tell the master which of them are still running
+	nodeid := PersistentId(NodeIdPath(processes))
+	tasks := map[string]*WorkerJob{}
 
-	mcon := *NewConnection(ws, true)
 	wm := WorkerMessage{Type: HELLO}
-	wm.BodyFromInterface(HelloMsgBody{JobCapacity: processes, RunningJobs: 0})
+	wm.BodyFromInterface(HelloMsgBody{JobCapacity: capacity, RunningJobs: 0, UniqueId: nodeid, PathMap: pathmap,
+		ProtocolVersion: protocolversion, Capabilities: AllCapabilities(), Session: Session()})
 	logger.Printf("Hello msg body: %v", wm.Body)
 	mcon.OutChan <- wm
-	go CheckIn(&mcon)
+	checkins := time.Tick(time.Duration(checkinseconds) * time.Second)
 	replyc := make(chan *WorkerMessage)
 
+	//the first SIGTERM or SIGINT drains running tasks, a second one exits immediately
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	draining := false
+	var drained, killed <-chan time.Time
+
 	for {
 		logger.Debug("Waiting for done or msg.")
 		select {
 		case <-mcon.DiedChan:
 			wm = WorkerMessage{Type: HELLO}
-			wm.BodyFromInterface(HelloMsgBody{JobCapacity: processes, RunningJobs: running})
+			wm.BodyFromInterface(HelloMsgBody{JobCapacity: capacity, RunningJobs: running, UniqueId: nodeid, PathMap: pathmap, Tasks: RunningTasks(tasks),
+				ProtocolVersion: protocolversion, Capabilities: AllCapabilities(), Session: Session(), Received: mcon.Received()})
 			mcon.ReConChan <- wm
+		case sig := <-signals:
+			if draining {
+				logger.Printf("%v: exiting now with %d tasks running", sig, running)
+				os.Exit(1)
+			}
+			logger.Printf("%v: draining %d running tasks", sig, running)
+			draining = true
+			capacity = 0
+			idlechecks = nil
+			mcon.OutChan <- WorkerMessage{Type: CAPACITY, Body: "0"}
+			drained = time.After(time.Duration(drainseconds) * time.Second)
+		case <-drained:
+			logger.Printf("drain timeout: stopping %d running tasks", running)
+			jk.Signalchan <- syscall.SIGTERM
+			killed = time.After(time.Duration(10) * time.Second)
+		case <-killed:
+			logger.Printf("killing %d running tasks", running)
+			jk.Signalchan <- syscall.SIGKILL
+		case <-checkins:
+			mcon.OutChan <- CheckIn(running)
+		case <-idlechecks:
+			if c := idle.Capacity(running); c != capacity {
+				logger.Printf("advertising capacity %d of %d", c, processes)
+				capacity = c
+				mcon.OutChan <- WorkerMessage{Type: CAPACITY, Body: strconv.Itoa(capacity)}
+			}
 		case rv := <-replyc:
 			logger.Debug("Got 'done' signal")
 			mcon.OutChan <- *rv
 			running--
+			if job := NewWorkerJob(rv.Body); job != nil {
+				delete(tasks, job.Key())
+			}
 
 		case msg := <-mcon.InChan:
 			logger.Debug("Got master msg")
 			switch msg.Type {
 			case START:
 				logger.Printf("START")
-				go StartJob(&mcon, replyc, msg.Body, jk)
+				//a master that knows capacity messages can give the task to another worker, older ones still get it run
+				if draining && mcon.Allows(CAPACITY) {
+					logger.Printf("draining: handing the task back")
+					mcon.OutChan <- WorkerMessage{Type: JOBERROR, SubId: msg.SubId, Body: msg.Body, ErrMsg: "the worker is draining", Returned: true}
+					break
+				}
+				if job := NewWorkerJob(msg.Body); job != nil {
+					tasks[job.Key()] = job
+				}
+				go StartJob(mcon, replyc, msg.Body, jk, stager, bundles)
 				running++
 			case KILL:
 				logger.Printf("KILL: %v", msg.SubId)
@@ -183,7 +416,25 @@ func RunNode(processes int, master string) {
 			case DIE:
 				logger.Printf("DIE: %v", msg.SubId)
 				DieIn(0)
+			case CLEANUP:
+				logger.Printf("CLEANUP: %v", msg.SubId)
+				go bundles.Release(msg.SubId)
+			case WELCOME:
+				if msg.ErrMsg != "" {
+					logger.Printf("refused by the master: %v", msg.ErrMsg)
+					os.Exit(1)
+				}
+				logger.Printf("WELCOME: protocol version %d with %v", mcon.Protocol().ProtocolVersion, mcon.Protocol().Capabilities)
+			}
+		}
+
+		if draining && running <= 0 {
+			logger.Printf("all tasks reported, shutting down")
+			if mcon.Flush(time.Duration(10)*time.Second) == false {
+				logger.Printf("timed out sending final messages")
 			}
+			mcon.Close()
+			os.Exit(0)
 		}
 	}
 
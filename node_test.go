@@ -0,0 +1,71 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// a draining worker run with -local hands a task it is sent back, and the master sends it out again as the same attempt
+func TestLocalDrainHandsTasksBack(t *testing.T) {
+	mcon, wcon := NewLocalConnections()
+	if !wcon.Allows(CAPACITY) || !mcon.Allows(CAPACITY) {
+		t.Fatalf("local connections don't allow capacity messages")
+	}
+
+	job := &WorkerJob{SubId: "job", LineId: 2, JobId: 3, Attempt: 1}
+	jobjson, _ := json.Marshal(job)
+	if !HandBack(wcon, WorkerMessage{Type: START, SubId: job.SubId, Body: string(jobjson)}) {
+		t.Fatalf("the task wasn't handed back")
+	}
+	msg := <-mcon.InChan
+	if msg.Type != JOBERROR || !msg.Returned {
+		t.Fatalf("handed back as %+v", msg)
+	}
+
+	sub := &Submission{Details: make(chan JobDetails, 1), jobChan: make(chan *WorkerJob, 1)}
+	sub.Details <- JobDetails{JobId: job.SubId, State: RUNNING}
+	nh := &NodeHandle{Master: &Master{subMap: map[string]*Submission{job.SubId: sub}}, Hostname: "local",
+		MaxJobs: make(chan int, 1), Running: make(chan int, 1), Tasks: make(chan map[string]*WorkerJob, 1), Update: make(chan int, 10)}
+	nh.MaxJobs <- 1
+	nh.Running <- 1
+	nh.Tasks <- map[string]*WorkerJob{job.Key(): job}
+	nh.HandleWorkerMessage(&msg)
+
+	select {
+	case again := <-sub.jobChan:
+		if again.Key() != job.Key() || again.Attempt != job.Attempt {
+			t.Fatalf("sent out again as %+v", again)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the task wasn't sent out again")
+	}
+}
+
+// a worker connected to a master that doesn't know capacity messages runs what it is sent
+func TestNoHandBackWithoutCapacity(t *testing.T) {
+	_, wcon := NewLocalConnections()
+	wcon.SetProtocol(WelcomeMsgBody{ProtocolVersion: 1})
+	if HandBack(wcon, WorkerMessage{Type: START, Body: "{}"}) {
+		t.Fatalf("handed a task back to a master that can't send it out again")
+	}
+}
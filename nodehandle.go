@@ -21,6 +21,7 @@ package main
 
 import (
 	"encoding/json"
+	"strconv"
 	"time"
 )
 
@@ -28,56 +29,51 @@ type NodeHandle struct {
 	NodeId        string
 	Uri           string
 	Hostname      string
+	PathMap       PathMap
 	Master        *Master
-	Con           Connection
+	Con           *Connection
 	MaxJobs       chan int
 	Running       chan int
+	Tasks         chan map[string]*WorkerJob // tasks sent to the worker that it hasn't reported on, by WorkerJob.Key
+	Metrics       chan []NodeMetrics         // most recent check-ins, oldest first
 	Update        chan int
 	BroadcastChan chan *WorkerMessage
+	Reattached    chan int // signaled when the worker reconnects after its socket died
+	resuming      chan int // held while a reconnected socket is taken over, the node isn't removed meanwhile
+	stop          chan int // closed once the node is removed
 }
 
-func NewNodeHandle(n *Connection, m *Master) *NodeHandle {
-	logger.Debug("NewNodeHandle(%v)", n.isWorker)
-	con := *n
-	id := UniqueId()
+func NewNodeHandle(con *Connection, m *Master, hello *HelloMsgBody, hostname string) *NodeHandle {
+	logger.Debug("NewNodeHandle(%v)", con.isWorker)
+	id := hello.UniqueId
+	if id == "" {
+		id = UniqueId()
+	}
 	nh := NodeHandle{NodeId: id,
 		Uri:           "/nodes/" + id,
-		Hostname:      con.Socket.RemoteAddr().String(),
+		Hostname:      hostname,
+		PathMap:       hello.PathMap,
 		Master:        m,
 		Con:           con,
 		MaxJobs:       make(chan int, 1),
 		Running:       make(chan int, 1),
+		Tasks:         make(chan map[string]*WorkerJob, 1),
+		Metrics:       make(chan []NodeMetrics, 1),
 		Update:        make(chan int, 10),
-		BroadcastChan: make(chan *WorkerMessage, 0)}
-
-	//wait for worker handshake TODO: should this be in monitor???
-	nh.Running <- 0
-	logger.Debug("NewNodeHandle(%v) waiting for first message", n.isWorker)
-	msg := <-nh.Con.InChan
+		BroadcastChan: make(chan *WorkerMessage, 0),
+		Reattached:    make(chan int, 1),
+		resuming:      make(chan int, 1),
+		stop:          make(chan int)}
 
-	if msg.Type == HELLO {
-		logger.Printf("Node Hello Body:%v", msg.Body)
-		val, err := NewHelloMsgBody(msg.Body)
-		if err != nil {
-			logger.Warn(err)
-			return nil
-		}
-		nh.MaxJobs <- val.JobCapacity
-		if val.UniqueId != "" {
-			nh.NodeId = val.UniqueId
-			nh.Uri = "/nodes/" + val.UniqueId
-			<-nh.Running
-			nh.Running <- val.RunningJobs
-		}
-		if val.RunningJobs != 0 {
-			<-nh.Running
-			nh.Running <- val.RunningJobs
-		}
-	} else {
-		logger.Debug("%v didn't say hello as first message.", nh.Hostname)
-		return nil
+	tasks := map[string]*WorkerJob{}
+	for i := range hello.Tasks {
+		tasks[hello.Tasks[i].Key()] = &hello.Tasks[i]
 	}
-	logger.Debug("%v says hello and asks for %v jobs.", nh.Hostname, msg.Body)
+	nh.Tasks <- tasks
+	nh.MaxJobs <- hello.JobCapacity
+	nh.Running <- hello.RunningJobs
+	nh.Metrics <- []NodeMetrics{}
+	logger.Debug("%v says hello and asks for %v jobs.", nh.Hostname, hello.JobCapacity)
 	return &nh
 }
 
@@ -90,6 +86,25 @@ func (nh *NodeHandle) Stats() (processes int, running int) {
 	return
 }
 
+// returns the node's most recent metrics and its check-in history
+func (nh *NodeHandle) LatestMetrics() (latest NodeMetrics, history []NodeMetrics) {
+	history = <-nh.Metrics
+	nh.Metrics <- history
+	if len(history) > 0 {
+		latest = history[len(history)-1]
+	}
+	return
+}
+
+func (nh *NodeHandle) RecordMetrics(m *NodeMetrics) {
+	history := <-nh.Metrics
+	history = append(history, *m)
+	if len(history) > metricshistory {
+		history = append([]NodeMetrics{}, history[len(history)-metricshistory:]...)
+	}
+	nh.Metrics <- history
+}
+
 func (nh *NodeHandle) ReSize(newMaxJobs int) {
 	logger.Debug("ReSize(%d)", newMaxJobs)
 	<-nh.MaxJobs
@@ -106,10 +121,99 @@ func (nh *NodeHandle) SendJob(j *WorkerJob) {
 	}
 	msg := WorkerMessage{Type: START, Body: string(jobjson)}
 	nh.Con.OutChan <- msg
+	tasks := <-nh.Tasks
+	tasks[j.Key()] = j
 	running := <-nh.Running
 	nh.Running <- running + 1
+	nh.Tasks <- tasks
 	logger.Debug("assigning [%v, %d]", nh.Hostname, running)
-	nh.Master.GetSub(job.SubId).SubmittedChan <- &SubmitedWorkerJob{j, nh.Hostname}
+	if s := nh.Master.GetSub(job.SubId); s != nil {
+		s.SubmittedChan <- &SubmitedWorkerJob{j, nh.Hostname}
+	}
+}
+
+// the job a worker's message is about, nil if the master doesn't know it (as after a restart, when a reconnecting
+// worker reports on tasks of earlier jobs) and the message is dropped
+func (nh *NodeHandle) sub(msg *WorkerMessage) *Submission {
+	s := nh.Master.GetSub(msg.SubId)
+	if s == nil {
+		logger.Debug("dropping message type %d from %v about unknown job %v", msg.Type, nh.Hostname, msg.SubId)
+	}
+	return s
+}
+
+// forgets a task the worker has reported on, returns false if it wasn't outstanding on this node
+func (nh *NodeHandle) Release(job *WorkerJob) bool {
+	tasks := <-nh.Tasks
+	_, isin := tasks[job.Key()]
+	delete(tasks, job.Key())
+	running := <-nh.Running
+	//tasks the worker was running before it first said hello aren't tracked
+	if isin || running > len(tasks) {
+		running--
+	}
+	nh.Running <- running
+	nh.Tasks <- tasks
+	return isin
+}
+
+// reconciles the tasks a reconnecting worker says are still running with those sent to it.
+// tasks it doesn't mention are lost unless their results, which may still be queued on the worker, arrive within reconnectseconds
+func (nh *NodeHandle) Reconcile(hello *HelloMsgBody) {
+	logger.Printf("Reconcile(%v): %d tasks still running", nh.NodeId, len(hello.Tasks))
+	reported := map[string]bool{}
+	tasks := <-nh.Tasks
+	for i := range hello.Tasks {
+		key := hello.Tasks[i].Key()
+		reported[key] = true
+		if _, isin := tasks[key]; !isin {
+			tasks[key] = &hello.Tasks[i]
+		}
+	}
+	missing := []*WorkerJob{}
+	for key, job := range tasks {
+		if !reported[key] {
+			missing = append(missing, job)
+		}
+	}
+	<-nh.Running
+	nh.Running <- len(tasks)
+	nh.Tasks <- tasks
+
+	nh.ReSize(hello.JobCapacity)
+	if len(missing) > 0 {
+		go nh.LoseTasks(missing, reconnectseconds)
+	}
+}
+
+// resubmits the given tasks if they are still outstanding after the given number of seconds
+func (nh *NodeHandle) LoseTasks(jobs []*WorkerJob, after int) {
+	logger.Debug("LoseTasks(%v, %d)", nh.NodeId, len(jobs))
+	<-time.After(time.Duration(after) * time.Second)
+	for _, job := range jobs {
+		if nh.Release(job) == false {
+			continue
+		}
+		logger.Printf("task %v lost on %v", job.Key(), nh.Hostname)
+		if s := nh.Master.GetSub(job.SubId); s != nil {
+			go s.Requeue(job)
+		}
+	}
+	select {
+	case nh.Update <- 1:
+	default:
+	}
+}
+
+// every task sent to the worker that it hasn't reported on
+func (nh *NodeHandle) Outstanding() []*WorkerJob {
+	tasks := <-nh.Tasks
+	nh.Tasks <- tasks
+	rv := make([]*WorkerJob, 0, len(tasks))
+	for _, job := range tasks {
+		rv = append(rv, job)
+	}
+	return rv
 }
 
 func (nh *NodeHandle) Monitor() {
@@ -120,7 +224,7 @@ func (nh *NodeHandle) Monitor() {
 		//logger.Debug("[%v %d %d]", nh.Hostname, processes, running)
 
 		switch {
-		case running < processes:
+		case running < processes && nh.Con.Connected():
 			//logger.Debug("waiting for job or message [%v, %d]", nh.Hostname, running)
 			select {
 			case bcMsg := <-nh.BroadcastChan:
@@ -129,6 +233,8 @@ func (nh *NodeHandle) Monitor() {
 			case job := <-nh.Master.jobChan:
 				nh.SendJob(job)
 			case <-nh.Update:
+			case <-nh.stop:
+				return
 			case <-time.After(time.Second):
 
 			}
@@ -139,7 +245,8 @@ func (nh *NodeHandle) Monitor() {
 				logger.Debug("broadcasting [%v, %v]", nh.Hostname, *bcMsg)
 				nh.Con.OutChan <- *bcMsg
 			case <-nh.Update:
-
+			case <-nh.stop:
+				return
 			case <-time.After(1 * time.Second):
 
 			}
@@ -150,24 +257,61 @@ func (nh *NodeHandle) Monitor() {
 func (nh *NodeHandle) MonitorIO() {
 	logger.Debug("MonitorIO(): [%v]", nh.Hostname)
 	for {
-		msg := <-nh.Con.InChan
-		nh.HandleWorkerMessage(&msg)
+		select {
+		case msg := <-nh.Con.InChan:
+			nh.HandleWorkerMessage(&msg)
+		case <-nh.stop:
+			return
+		}
 	}
 }
 
 //handle worker messages and updates the value in nh.Running if appropriate
 func (nh *NodeHandle) HandleWorkerMessage(msg *WorkerMessage) {
 	//logger.Debug("message from: %v", nh.Hostname)
+	if msg.flushed != nil {
+		//a local worker is waiting for its messages to be handled
+		close(msg.flushed)
+		return
+	}
 	switch msg.Type {
 	default:
 	case CHECKIN:
 		logger.Debug("CHECKIN [%v]", nh.Hostname)
+		if msg.Body != "" {
+			m, err := NewNodeMetrics(msg.Body)
+			if err != nil {
+				logger.Warn(err)
+				return
+			}
+			nh.RecordMetrics(m)
+		}
+	case CAPACITY:
+		logger.Printf("CAPACITY [%v, %v]", nh.Hostname, msg.Body)
+		capacity, err := strconv.Atoi(msg.Body)
+		if err != nil {
+			logger.Warn(err)
+			return
+		}
+		nh.ReSize(capacity)
+		select {
+		case nh.Update <- 1:
+		default:
+		}
 	case COUT:
 		//logger.Debug("COUT [%v]", nh.Hostname)
+		s := nh.sub(msg)
+		if s == nil {
+			return
+		}
+		if msg.Chunk != nil {
+			s.WriteChunk(msg)
+			return
+		}
 		blocked := true
 		for blocked == true {
 			select {
-			case nh.Master.GetSub(msg.SubId).CoutFileChan <- msg.Body:
+			case s.CoutFileChan <- TaskOutput{LineId: msg.LineId, JobId: msg.JobId, Attempt: msg.Attempt, Text: msg.Body}:
 				blocked = false
 			case <-time.After(1 * time.Second):
 				logger.Printf("Sending  COUT to subid %v blocked for more then 1 second.", msg.SubId)
@@ -176,33 +320,90 @@ func (nh *NodeHandle) HandleWorkerMessage(msg *WorkerMessage) {
 
 	case CERROR:
 		//logger.Debug("CERROR [%v]", nh.Hostname)
+		s := nh.sub(msg)
+		if s == nil {
+			return
+		}
+		if msg.Chunk != nil {
+			s.WriteChunk(msg)
+			return
+		}
 		blocked := true
 		for blocked == true {
 			select {
-			case nh.Master.GetSub(msg.SubId).CerrFileChan <- msg.Body:
+			case s.CerrFileChan <- TaskOutput{LineId: msg.LineId, JobId: msg.JobId, Attempt: msg.Attempt, Text: msg.Body}:
 				blocked = false
 			case <-time.After(1 * time.Second):
 				logger.Printf("Sending  CERROR to subid %v blocked for more then 1 second.", msg.SubId)
 			}
 		}
 
+	case RESULT:
+		s := nh.sub(msg)
+		if s == nil {
+			return
+		}
+		result := TaskResult{LineId: msg.LineId, TaskId: msg.JobId, Attempt: msg.Attempt, Result: json.RawMessage(msg.Body)}
+		blocked := true
+		for blocked == true {
+			select {
+			case s.ResultChan <- result:
+				blocked = false
+			case <-time.After(1 * time.Second):
+				logger.Printf("Sending  RESULT to subid %v blocked for more then 1 second.", msg.SubId)
+			}
+		}
+
+	case TASKSTARTED:
+		s := nh.sub(msg)
+		if s == nil {
+			return
+		}
+		go func() {
+			job := NewWorkerJob(msg.Body)
+			s.StartedChan <- &SubmitedWorkerJob{job, nh.Hostname}
+		}()
 	case JOBFINISHED:
 		go func() {
 			logger.Debug("JOBFINISHED [%v]", nh.Hostname)
-			running := <-nh.Running
-			nh.Running <- running - 1
+			job := NewWorkerJob(msg.Body)
+			nh.Release(job)
+			_, running := nh.Stats()
 			logger.Debug("JOBFINISHED [%v, %v, %v]", nh.Hostname, msg.Body, running)
-			nh.Master.GetSub(msg.SubId).FinishedChan <- NewWorkerJob(msg.Body)
+			s := nh.sub(msg)
+			if s == nil {
+				nh.Update <- 1
+				return
+			}
+			if msg.Overage != nil {
+				s.AddTaskOverage(msg.Overage)
+			}
+			s.FinishedChan <- &EndedWorkerJob{wj: job, host: nh.Hostname, exit: msg.Exit, counts: msg.Counts}
 			nh.Update <- 1
 			logger.Printf("JOBFINISHED [%v, %v, %v]", nh.Hostname, msg.Body, running)
 		}()
 	case JOBERROR:
 		go func() {
 			logger.Debug("JOBERROR %v", nh.Hostname)
-			running := <-nh.Running
-			nh.Running <- running - 1
+			job := NewWorkerJob(msg.Body)
+			nh.Release(job)
+			s := nh.sub(msg)
+			if s == nil {
+				nh.Update <- 1
+				return
+			}
+			if msg.Returned {
+				logger.Printf("task %v handed back by %v: %v", job.Key(), nh.Hostname, msg.ErrMsg)
+				nh.Update <- 1
+				s.Return(job)
+				return
+			}
+			_, running := nh.Stats()
 			logger.Debug("JOBERROR running [%v, %v, %v]", nh.Hostname, msg.Body, running)
-			nh.Master.GetSub(msg.SubId).ErrorChan <- NewWorkerJob(msg.Body)
+			if msg.Overage != nil {
+				s.AddTaskOverage(msg.Overage)
+			}
+			s.ErrorChan <- &EndedWorkerJob{wj: job, host: nh.Hostname, exit: msg.Exit, errmsg: msg.ErrMsg, counts: msg.Counts}
 			nh.Update <- 1
 			logger.Printf("JOBERROR finished sent: [%v, %v, %v]", nh.Hostname, msg.Body, running)
 		}()
@@ -0,0 +1,88 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// a restarted master drops what a reconnecting worker reports about jobs it doesn't know instead of panicking
+func TestMessagesAboutUnknownJob(t *testing.T) {
+	nh := &NodeHandle{Master: &Master{subMap: map[string]*Submission{}, archived: map[string]string{}}, Hostname: "worker",
+		MaxJobs: make(chan int, 1), Running: make(chan int, 1), Tasks: make(chan map[string]*WorkerJob, 1), Update: make(chan int, 10)}
+	nh.MaxJobs <- 1
+	nh.Running <- 1
+	job := &WorkerJob{SubId: "unknown", LineId: 0, JobId: 0}
+	nh.Tasks <- map[string]*WorkerJob{job.Key(): job}
+	jobjson, _ := json.Marshal(job)
+
+	for _, msg := range []WorkerMessage{
+		{Type: COUT, SubId: "unknown", Body: "out\n"},
+		{Type: CERROR, SubId: "unknown", Chunk: &OutputChunk{Seq: 1, Data: []byte("err")}},
+		{Type: RESULT, SubId: "unknown", Body: "{}"},
+		{Type: TASKSTARTED, SubId: "unknown", Body: string(jobjson)},
+		{Type: JOBFINISHED, SubId: "unknown", Body: string(jobjson)},
+		{Type: JOBERROR, SubId: "unknown", Body: string(jobjson), Returned: true},
+	} {
+		nh.HandleWorkerMessage(&msg)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-nh.Update:
+		case <-time.After(time.Second):
+			t.Fatalf("the ends of tasks of an unknown job weren't handled")
+		}
+	}
+	if _, running := nh.Stats(); running != 0 {
+		t.Fatalf("%d tasks still running", running)
+	}
+}
+
+// a node that doesn't take broadcasts doesn't hold up the others, and is given up on once removed
+func TestBroadcastDoesNotWait(t *testing.T) {
+	stuck := &NodeHandle{NodeId: "stuck", BroadcastChan: make(chan *WorkerMessage), stop: make(chan int)}
+	ready := &NodeHandle{NodeId: "ready", BroadcastChan: make(chan *WorkerMessage), stop: make(chan int)}
+	m := &Master{NodeHandles: map[string]*NodeHandle{stuck.NodeId: stuck, ready.NodeId: ready}}
+
+	broadcast := make(chan int)
+	go func() {
+		m.Broadcast(&WorkerMessage{Type: CLEANUP, SubId: "A1B2C3"})
+		close(broadcast)
+	}()
+	select {
+	case <-broadcast:
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("Broadcast waited for the nodes")
+	}
+	m.nodeMu.Lock()
+	m.nodeMu.Unlock()
+
+	select {
+	case msg := <-ready.BroadcastChan:
+		if msg.Type != CLEANUP || msg.SubId != "A1B2C3" {
+			t.Fatalf("broadcast %+v", *msg)
+		}
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("the ready node wasn't sent the broadcast")
+	}
+	close(stuck.stop)
+}
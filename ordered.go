@@ -0,0 +1,259 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// bytes of a job's ordered output held in memory for each stream, output past this is buffered in a temporary file
+const orderedmemory = 16 << 20
+
+// a task ending, with the number of output messages it sent on the stream or -1 if that isn't known
+type TaskEnd struct {
+	LineId   int
+	JobId    int
+	Attempt  int
+	Messages int
+}
+
+// part of the spill file holding a task's output
+type spillSegment struct {
+	offset int64
+	length int64
+}
+
+// output of a task waiting for the tasks before it to end
+type orderedTask struct {
+	lineId   int
+	attempt  int
+	mem      []byte
+	spilled  []spillSegment // output past the memory limit, in the spill file
+	spilling bool
+	ended    bool
+	expected int // output messages the task sent, -1 if not known
+	received int
+}
+
+// true once the task has ended and all the output it sent has arrived
+func (t *orderedTask) complete() bool {
+	return t.ended && (t.expected < 0 || t.received >= t.expected)
+}
+
+// writes the output of each task to a merged output file in task order, once the task and every task before it have ended
+type OrderedOutput struct {
+	out       io.Writer
+	index     *OutputIndex
+	tasks     map[int]*orderedTask
+	next      int // task whose output is written next
+	inmem     int
+	spill     *os.File // shared by every task that doesn't fit in memory
+	spillsize int64
+	spilled   int64 // bytes in the spill file of tasks not yet written or dropped
+}
+
+func NewOrderedOutput(out io.Writer, index *OutputIndex) *OrderedOutput {
+	return &OrderedOutput{out: out, index: index, tasks: map[int]*orderedTask{}}
+}
+
+func (this *OrderedOutput) task(lineId int, jobId int) *orderedTask {
+	t, isin := this.tasks[jobId]
+	if !isin {
+		t = &orderedTask{lineId: lineId, expected: -1}
+		this.tasks[jobId] = t
+	}
+	return t
+}
+
+// moves on to a later attempt of a task, dropping the output of earlier ones. returns false for an earlier attempt
+func (this *OrderedOutput) attempt(t *orderedTask, attempt int) bool {
+	switch {
+	case attempt < t.attempt:
+		return false
+	case attempt > t.attempt:
+		this.Drop(t)
+		t.attempt = attempt
+		t.ended = false
+		t.expected = -1
+		t.received = 0
+	}
+	return true
+}
+
+// buffers output of a task, output of an earlier attempt of the task is dropped
+func (this *OrderedOutput) Write(msg TaskOutput) error {
+	if msg.JobId < this.next {
+		logger.Printf("WARNING OrderedOutput() dropping output of written task %d", msg.JobId)
+		return nil
+	}
+	t := this.task(msg.LineId, msg.JobId)
+	if !this.attempt(t, msg.Attempt) {
+		return nil
+	}
+	t.received++
+
+	if !t.spilling && this.inmem+len(msg.Text) > orderedmemory {
+		if err := this.Spill(t); err != nil {
+			return err
+		}
+	}
+	if t.spilling {
+		if err := this.spillWrite(t, []byte(msg.Text)); err != nil {
+			return err
+		}
+	} else {
+		t.mem = append(t.mem, msg.Text...)
+		this.inmem += len(msg.Text)
+	}
+	if msg.JobId == this.next {
+		return this.advance()
+	}
+	return nil
+}
+
+// moves the output a task has buffered in memory to the spill file, where the rest of its output goes
+func (this *OrderedOutput) Spill(t *orderedTask) error {
+	if this.spill == nil {
+		f, err := ioutil.TempFile("", "golem-ordered-")
+		if err != nil {
+			return err
+		}
+		this.spill = f
+	}
+	t.spilling = true
+	mem := t.mem
+	this.inmem -= len(mem)
+	t.mem = nil
+	return this.spillWrite(t, mem)
+}
+
+// appends output of a task to the spill file
+func (this *OrderedOutput) spillWrite(t *orderedTask, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	n, err := this.spill.WriteAt(data, this.spillsize)
+	if n > 0 {
+		last := len(t.spilled) - 1
+		if last >= 0 && t.spilled[last].offset+t.spilled[last].length == this.spillsize {
+			t.spilled[last].length += int64(n)
+		} else {
+			t.spilled = append(t.spilled, spillSegment{this.spillsize, int64(n)})
+		}
+		this.spillsize += int64(n)
+		this.spilled += int64(n)
+	}
+	return err
+}
+
+// discards the output a task has buffered, the spill file is emptied once no task has output in it
+func (this *OrderedOutput) Drop(t *orderedTask) {
+	this.inmem -= len(t.mem)
+	t.mem = nil
+	for _, seg := range t.spilled {
+		this.spilled -= seg.length
+	}
+	t.spilled = nil
+	t.spilling = false
+	if this.spill != nil && this.spilled == 0 && this.spillsize > 0 {
+		if err := this.spill.Truncate(0); err != nil {
+			logger.Warn(err)
+			return
+		}
+		this.spillsize = 0
+	}
+}
+
+// marks a task ended and writes out the tasks that are next in order and have all their output
+func (this *OrderedOutput) End(end TaskEnd) error {
+	if end.JobId < this.next {
+		return nil
+	}
+	t := this.task(end.LineId, end.JobId)
+	if !this.attempt(t, end.Attempt) {
+		return nil
+	}
+	t.ended = true
+	t.expected = end.Messages
+	return this.advance()
+}
+
+// writes out the tasks that are next in order and complete
+func (this *OrderedOutput) advance() error {
+	for {
+		t, isin := this.tasks[this.next]
+		if !isin || !t.complete() {
+			return nil
+		}
+		if err := this.WriteTask(this.next, t); err != nil {
+			return err
+		}
+		this.next++
+	}
+}
+
+// appends the output of a task to the output file
+func (this *OrderedOutput) WriteTask(jobId int, t *orderedTask) error {
+	defer this.Drop(t)
+	delete(this.tasks, jobId)
+
+	var n int64
+	var err error
+	if t.mem != nil {
+		var written int
+		written, err = this.out.Write(t.mem)
+		n = int64(written)
+	}
+	for _, seg := range t.spilled {
+		if err != nil {
+			break
+		}
+		var copied int64
+		copied, err = io.Copy(this.out, io.NewSectionReader(this.spill, seg.offset, seg.length))
+		n += copied
+	}
+	if this.index != nil && n > 0 {
+		this.index.Add(t.lineId, jobId, int(n))
+	}
+	return err
+}
+
+// writes out the output of the tasks that haven't ended, such as those of a stopped job, in task order
+func (this *OrderedOutput) Close() error {
+	jobIds := []int{}
+	for jobId := range this.tasks {
+		jobIds = append(jobIds, jobId)
+	}
+	sort.Ints(jobIds)
+	var rv error
+	for _, jobId := range jobIds {
+		if err := this.WriteTask(jobId, this.tasks[jobId]); err != nil && rv == nil {
+			rv = err
+		}
+	}
+	if this.spill != nil {
+		this.spill.Close()
+		os.Remove(this.spill.Name())
+	}
+	return rv
+}
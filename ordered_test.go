@@ -0,0 +1,76 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// the raw output of task 0 as the worker sends it, one chunk per byte, and the chunk count it reports
+func rawChunks(t *testing.T, text string) ([]WorkerMessage, int) {
+	ch := make(chan WorkerMessage, len(text))
+	done := make(chan int, 1)
+	job := &WorkerJob{SubId: "job", LineId: 0, JobId: 0}
+	PipeChunksToChan(iotest.OneByteReader(strings.NewReader(text)), COUT, job, NewOutputLimiter(0, 0), ch, done)
+	close(ch)
+	msgs := []WorkerMessage{}
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	return msgs, <-done
+}
+
+func TestPipeChunksToChanCounts(t *testing.T) {
+	msgs, count := rawChunks(t, "abc")
+	if count != 3 || len(msgs) != 3 {
+		t.Fatalf("sent %d chunks, counted %d", len(msgs), count)
+	}
+}
+
+// a raw output task's last chunk arriving after the task's end is still written, in order
+func TestOrderedChunksAfterEnd(t *testing.T) {
+	msgs, count := rawChunks(t, "ab")
+	out := &bytes.Buffer{}
+	ordered := NewOrderedOutput(out, nil)
+	defer ordered.Close()
+	chunks := NewChunkSequencer()
+	write := func(msg WorkerMessage) {
+		chunks.Add(ChunkStream(&msg), msg.Chunk, func(data []byte) {
+			if err := ordered.Write(TaskOutput{LineId: msg.LineId, JobId: msg.JobId, Text: string(data)}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	write(msgs[0])
+	if err := ordered.End(TaskEnd{JobId: 0, Messages: count}); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() > 0 {
+		t.Fatalf("wrote %q before the last chunk arrived", out.String())
+	}
+	write(msgs[1])
+	if out.String() != "ab" {
+		t.Fatalf("wrote %q", out.String())
+	}
+}
@@ -0,0 +1,549 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// task output modes
+const (
+	LINEOUTPUT = "lines" // output is forwarded line by line, the default
+	RAWOUTPUT  = "raw"   // output is forwarded byte for byte in numbered chunks
+)
+
+// how the master writes the output of a job's tasks
+const (
+	MERGEDFILES  = "merged"  // one stdout and one stderr file for the whole job, the default
+	SPLITFILES   = "split"   // one stdout and one stderr file for each task
+	ORDEREDFILES = "ordered" // like merged, with the output of each task written together in task order once it ends
+)
+
+// the most raw output sent in a single message
+const chunksize = 32 * 1024
+
+// the most split output files the master keeps open for each stream of a job
+const maxsplitfiles = 64
+
+// a piece of raw task output, numbered from 1 within each stream of each task attempt
+type OutputChunk struct {
+	Seq  int
+	Data []byte
+}
+
+// forwards everything read from r as numbered chunks so the master can write it exactly as produced,
+// the number of chunks sent is sent on done
+func PipeChunksToChan(r io.Reader, msgType int, job *WorkerJob, limiter *OutputLimiter, ch chan WorkerMessage, done chan int) {
+	logger.Debug("PipeChunksToChan(%d,%v)", msgType, job.Key())
+	buf := make([]byte, chunksize)
+	seq := 1
+	for {
+		n, err := r.Read(buf)
+		//output past the task's limits is still read so the task isn't blocked writing it
+		data := []byte(limiter.Limit(string(buf[:n]), "task "+StreamName(msgType)))
+		if len(data) > 0 {
+			msg := WorkerMessage{Type: msgType, SubId: job.SubId, LineId: job.LineId, JobId: job.JobId, Attempt: job.Attempt, Chunk: &OutputChunk{Seq: seq, Data: data}}
+			blocked := true
+			for blocked == true {
+				select {
+				case ch <- msg:
+					blocked = false
+				case <-time.After(time.Second):
+					logger.Printf("WARNING PipeChunksToChan() has been blocked for more then 1 second MsgType:%d,id:%v", msgType, job.SubId)
+				}
+			}
+			seq++
+		}
+		if err != nil {
+			if err != io.EOF {
+				logger.Warn(err)
+			}
+			done <- seq - 1
+			return
+		}
+	}
+}
+
+// puts the raw output chunks of each task stream back in order, io monitors on the master may handle them out of order
+type ChunkSequencer struct {
+	mu       sync.Mutex
+	next     map[string]int
+	pending  map[string]map[int][]byte
+	expected map[string]int // chunks a stream whose task has ended sent, it is forgotten once they are written
+}
+
+func NewChunkSequencer() *ChunkSequencer {
+	return &ChunkSequencer{next: map[string]int{}, pending: map[string]map[int][]byte{}, expected: map[string]int{}}
+}
+
+// adds a chunk of the given stream and calls write, with the sequencer locked, for each chunk that is now in order
+func (cs *ChunkSequencer) Add(stream string, chunk *OutputChunk, write func([]byte)) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	next, isin := cs.next[stream]
+	if !isin {
+		next = 1
+	}
+	if chunk.Seq < next {
+		logger.Printf("duplicate output chunk %d of %v", chunk.Seq, stream)
+		return
+	}
+	if chunk.Seq > next {
+		if cs.pending[stream] == nil {
+			cs.pending[stream] = map[int][]byte{}
+		}
+		cs.pending[stream][chunk.Seq] = chunk.Data
+		return
+	}
+
+	write(chunk.Data)
+	next++
+	for data, waiting := cs.pending[stream][next]; waiting; data, waiting = cs.pending[stream][next] {
+		delete(cs.pending[stream], next)
+		write(data)
+		next++
+	}
+	if len(cs.pending[stream]) == 0 {
+		delete(cs.pending, stream)
+	}
+	cs.next[stream] = next
+	cs.forget(stream)
+}
+
+// notes the task of a stream has ended having sent the given number of chunks, the stream is forgotten once they
+// have all been written. when the count isn't known (-1) the stream is kept until the job is done
+func (cs *ChunkSequencer) End(stream string, chunks int) {
+	if chunks < 0 {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.expected[stream] = chunks
+	cs.forget(stream)
+}
+
+// forgets an ended stream whose chunks have all been written, called with the sequencer locked
+func (cs *ChunkSequencer) forget(stream string) {
+	expected, ended := cs.expected[stream]
+	next, isin := cs.next[stream]
+	if !isin {
+		next = 1
+	}
+	if !ended || next <= expected {
+		return
+	}
+	delete(cs.expected, stream)
+	delete(cs.next, stream)
+	delete(cs.pending, stream)
+}
+
+// forgets every stream once the job is done, including those of attempts lost with their worker
+func (cs *ChunkSequencer) Clear() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.pending) > 0 {
+		logger.Printf("WARNING output chunks of %d streams never followed the chunks before them", len(cs.pending))
+	}
+	cs.next = map[string]int{}
+	cs.pending = map[string]map[int][]byte{}
+	cs.expected = map[string]int{}
+}
+
+// identifies the output stream of one task attempt that a message belongs to
+func ChunkStream(msg *WorkerMessage) string {
+	return fmt.Sprintf("%d/%v/%d/%d/%d", msg.Type, msg.SubId, msg.LineId, msg.JobId, msg.Attempt)
+}
+
+// the tags a job asked to have prefixed to each line of its tasks' output
+type Attribution struct {
+	Task bool // lineid/taskid
+	Host bool // the worker's hostname
+	Time bool // when the worker read the line
+	host string
+}
+
+// parses a comma separated list of "task", "host" and "time"
+func ParseAttribution(value string) (a Attribution, err error) {
+	for _, tag := range strings.Split(value, ",") {
+		switch strings.TrimSpace(tag) {
+		case "":
+		case "task":
+			a.Task = true
+		case "host":
+			a.Host = true
+		case "time":
+			a.Time = true
+		default:
+			err = fmt.Errorf("invalid attribution %q (expected task, host or time)", tag)
+			return
+		}
+	}
+	if a.Host {
+		if a.host, err = os.Hostname(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// the prefix for a line of the job's output such as "[0/12 node7 2014-05-05T10:11:12.123Z] "
+func (a Attribution) Prefix(job *WorkerJob) string {
+	tags := []string{}
+	if a.Task {
+		tags = append(tags, fmt.Sprintf("%d/%d", job.LineId, job.JobId))
+	}
+	if a.Host {
+		tags = append(tags, a.host)
+	}
+	if a.Time {
+		tags = append(tags, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(tags, " ") + "] "
+}
+
+// output written to a job's merged stdout or stderr file and the task it came from
+type TaskOutput struct {
+	LineId  int
+	JobId   int
+	Attempt int
+	Text    string
+}
+
+func ValidOutputFiles(value string) error {
+	switch value {
+	case "", MERGEDFILES, SPLITFILES, ORDEREDFILES:
+		return nil
+	}
+	return fmt.Errorf("invalid output files %q (expected %v, %v or %v)", value, MERGEDFILES, SPLITFILES, ORDEREDFILES)
+}
+
+// directory in the job's output directory that its split output files are written to
+func SplitOutputDir(dir string, subId string) string {
+	return filepath.Join(dir, subId+".tasks")
+}
+
+// file holding one task's stdout or stderr when the job's output is split
+func SplitOutputPath(dir string, subId string, lineId int, jobId int, stream string) string {
+	return filepath.Join(SplitOutputDir(dir, subId), strconv.Itoa(lineId), strconv.Itoa(jobId), stream+".txt")
+}
+
+// writes each task's output to its own file, closed once the task has ended and all the output it counted is written.
+// when the sink can append to files at most maxsplitfiles are kept open, otherwise a closed file can't be reopened
+// and output arriving after it is dropped
+type SplitOutput struct {
+	sink        OutputSink
+	dir         string
+	subId       string
+	stream      string // stdout or stderr
+	compression string
+	files       map[string]io.WriteCloser
+	tasks       map[string]*splitTask
+	written     map[string]bool // files closed for good on a sink that can't append
+}
+
+// output of the latest attempt of a task received so far and how much to expect once it has ended
+type splitTask struct {
+	attempt  int
+	ended    bool
+	expected int
+	received int
+}
+
+func NewSplitOutput(sink OutputSink, dir string, subId string, stream string, compression string) *SplitOutput {
+	return &SplitOutput{sink: sink, dir: dir, subId: subId, stream: stream, compression: compression,
+		files: map[string]io.WriteCloser{}, tasks: map[string]*splitTask{}, written: map[string]bool{}}
+}
+
+func (so *SplitOutput) path(lineId int, jobId int) string {
+	return CompressedPath(SplitOutputPath(so.dir, so.subId, lineId, jobId, so.stream), so.compression)
+}
+
+// the task writing to fpath, restarted when a later attempt of it shows up
+func (so *SplitOutput) task(fpath string, attempt int) *splitTask {
+	t, isin := so.tasks[fpath]
+	if !isin || attempt > t.attempt {
+		t = &splitTask{attempt: attempt, expected: -1}
+		so.tasks[fpath] = t
+	}
+	return t
+}
+
+func (so *SplitOutput) Write(out TaskOutput) error {
+	fpath := so.path(out.LineId, out.JobId)
+	if so.written[fpath] {
+		logger.Printf("WARNING SplitOutput() dropping output of task %d written to %v", out.JobId, fpath)
+		return nil
+	}
+	t := so.task(fpath, out.Attempt)
+	if out.Attempt == t.attempt {
+		t.received++
+	}
+	f, isin := so.files[fpath]
+	if !isin {
+		var err error
+		if appender, ok := so.sink.(OutputAppender); ok {
+			if len(so.files) >= maxsplitfiles {
+				so.Close()
+			}
+			f, err = appender.Append(fpath)
+		} else {
+			f, err = so.sink.Create(fpath)
+		}
+		if err != nil {
+			return err
+		}
+		if f, err = CompressOutput(f, so.compression); err != nil {
+			return err
+		}
+		so.files[fpath] = f
+	}
+	_, err := io.WriteString(f, out.Text)
+	if err != nil {
+		return err
+	}
+	return so.closeEnded(fpath, t)
+}
+
+// notes a task has ended, its file is closed once the number of messages it sent has been written,
+// or at once when the count isn't known (the output sent before the end has been written by then)
+func (so *SplitOutput) End(end TaskEnd) error {
+	fpath := so.path(end.LineId, end.JobId)
+	t := so.task(fpath, end.Attempt)
+	if end.Attempt < t.attempt {
+		return nil
+	}
+	t.ended = true
+	t.expected = end.Messages
+	return so.closeEnded(fpath, t)
+}
+
+func (so *SplitOutput) closeEnded(fpath string, t *splitTask) error {
+	if !t.ended || t.received < t.expected {
+		return nil
+	}
+	delete(so.tasks, fpath)
+	f, isin := so.files[fpath]
+	if !isin {
+		return nil
+	}
+	delete(so.files, fpath)
+	if _, ok := so.sink.(OutputAppender); !ok {
+		so.written[fpath] = true
+	}
+	return f.Close()
+}
+
+func (so *SplitOutput) Flush() {
+	for _, f := range so.files {
+		FlushOutput(f)
+	}
+}
+
+// closes the open files, a sink that can append reopens them if more output comes
+func (so *SplitOutput) Close() {
+	for fpath, f := range so.files {
+		if err := f.Close(); err != nil {
+			logger.Warn(err)
+		}
+		delete(so.files, fpath)
+	}
+}
+
+// the output a task left and where to get it from the REST API
+type TaskOutputFiles struct {
+	LineId int
+	TaskId int
+	Stdout string // uri, empty if the task wrote nothing to stdout
+	Stderr string
+}
+
+type TaskOutputFilesList struct {
+	Items         []TaskOutputFiles
+	NumberOfItems int
+}
+
+// lists the tasks of a job that wrote output, found in its merged output indexes or split output directory
+func ListTaskOutputs(dir string, subId string) []TaskOutputFiles {
+	found := map[[2]int]*TaskOutputFiles{}
+	add := func(lineId int, taskId int, stream string) {
+		key := [2]int{lineId, taskId}
+		tof, isin := found[key]
+		if !isin {
+			tof = &TaskOutputFiles{LineId: lineId, TaskId: taskId}
+			found[key] = tof
+		}
+		uri := fmt.Sprintf("/jobs/%v/tasks/%d/%d/%v", subId, lineId, taskId, stream)
+		if stream == "stdout" {
+			tof.Stdout = uri
+		} else {
+			tof.Stderr = uri
+		}
+	}
+
+	for stream, outpath := range map[string]string{"stdout": filepath.Join(dir, subId+".out.txt"), "stderr": filepath.Join(dir, subId+".err.txt")} {
+		entries, _ := ReadOutputIndex(outpath)
+		for _, e := range entries {
+			add(e.LineId, e.JobId, stream)
+		}
+		matches, _ := filepath.Glob(filepath.Join(SplitOutputDir(dir, subId), "*", "*", stream+".txt*"))
+		for _, match := range matches {
+			taskDir := filepath.Dir(match)
+			lineId, err := strconv.Atoi(filepath.Base(filepath.Dir(taskDir)))
+			if err != nil {
+				continue
+			}
+			taskId, err := strconv.Atoi(filepath.Base(taskDir))
+			if err != nil {
+				continue
+			}
+			add(lineId, taskId, stream)
+		}
+	}
+
+	items := make([]TaskOutputFiles, 0, len(found))
+	for _, tof := range found {
+		items = append(items, *tof)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].LineId != items[j].LineId {
+			return items[i].LineId < items[j].LineId
+		}
+		return items[i].TaskId < items[j].TaskId
+	})
+	return items
+}
+
+// a byte range of a merged output file written by one task
+type IndexEntry struct {
+	Offset int64
+	Length int64
+	LineId int
+	JobId  int
+}
+
+// sidecar file recording which task wrote each byte range of a merged output file.
+// each line is "offset length lineid taskid", consecutive writes by the same task share a line
+type OutputIndex struct {
+	file    io.WriteCloser
+	offset  int64
+	pending *IndexEntry
+}
+
+// index file kept next to the job's merged output file
+func IndexPath(outpath string) string {
+	return outpath + ".idx"
+}
+
+func NewOutputIndex(sink OutputSink, outpath string) (*OutputIndex, error) {
+	f, err := sink.Create(IndexPath(outpath))
+	if err != nil {
+		return nil, err
+	}
+	return &OutputIndex{file: f}, nil
+}
+
+// records that n bytes were just appended to the output file by the given task
+func (idx *OutputIndex) Add(lineId int, jobId int, n int) {
+	if p := idx.pending; p != nil && p.LineId == lineId && p.JobId == jobId {
+		p.Length += int64(n)
+	} else {
+		idx.Flush()
+		idx.pending = &IndexEntry{Offset: idx.offset, Length: int64(n), LineId: lineId, JobId: jobId}
+	}
+	idx.offset += int64(n)
+}
+
+// writes out the range still being extended
+func (idx *OutputIndex) Flush() {
+	if idx.pending == nil {
+		return
+	}
+	p := idx.pending
+	if _, err := fmt.Fprintf(idx.file, "%d %d %d %d\n", p.Offset, p.Length, p.LineId, p.JobId); err != nil {
+		logger.Warn(err)
+	}
+	idx.pending = nil
+}
+
+func (idx *OutputIndex) Close() error {
+	idx.Flush()
+	return idx.file.Close()
+}
+
+func ReadOutputIndex(outpath string) ([]IndexEntry, error) {
+	f, err := os.Open(IndexPath(outpath))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []IndexEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e IndexEntry
+		if _, err := fmt.Sscan(scanner.Text(), &e.Offset, &e.Length, &e.LineId, &e.JobId); err != nil {
+			return nil, fmt.Errorf("%v: %v", IndexPath(outpath), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// copies the parts of a merged output file written by one task to w, the index holds offsets in the uncompressed output
+func CopyTaskOutput(w io.Writer, outpath string, lineId int, jobId int) error {
+	entries, err := ReadOutputIndex(outpath)
+	if err != nil {
+		return err
+	}
+	r, err := OpenOutputFile(outpath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var offset int64
+	for _, e := range entries {
+		if e.LineId != lineId || e.JobId != jobId {
+			continue
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, e.Offset-offset); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, e.Length); err != nil {
+			return err
+		}
+		offset = e.Offset + e.Length
+	}
+	return nil
+}
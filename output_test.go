@@ -0,0 +1,82 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// a task's split output file stays open for chunks arriving after the task's end, and is closed once they have
+func TestSplitChunksAfterEnd(t *testing.T) {
+	msgs, count := rawChunks(t, "ab")
+	dir := t.TempDir()
+	split := NewSplitOutput(LocalSink{}, dir, "job", "stdout", NOCOMPRESSION)
+	defer split.Close()
+	write := func(msg WorkerMessage) {
+		if err := split.Write(TaskOutput{LineId: msg.LineId, JobId: msg.JobId, Text: string(msg.Chunk.Data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(msgs[0])
+	if err := split.End(TaskEnd{JobId: 0, Messages: count}); err != nil {
+		t.Fatal(err)
+	}
+	if len(split.files) != 1 {
+		t.Fatalf("closed the task's file before its last chunk arrived")
+	}
+	write(msgs[1])
+	if len(split.files) != 0 {
+		t.Fatalf("left the task's file open once all its chunks arrived")
+	}
+	data, err := ioutil.ReadFile(SplitOutputPath(dir, "job", 0, 0, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ab" {
+		t.Fatalf("wrote %q", data)
+	}
+}
+
+// the sequencer keeps an ended stream until the chunks its task counted have been written, even out of order
+func TestChunkSequencerEnd(t *testing.T) {
+	msgs, count := rawChunks(t, "abc")
+	chunks := NewChunkSequencer()
+	written := ""
+	add := func(msg WorkerMessage) {
+		chunks.Add(ChunkStream(&msg), msg.Chunk, func(data []byte) { written += string(data) })
+	}
+	stream := ChunkStream(&msgs[0])
+
+	add(msgs[0])
+	add(msgs[2])
+	chunks.End(stream, count)
+	if _, isin := chunks.next[stream]; !isin || len(chunks.pending[stream]) != 1 {
+		t.Fatalf("forgot the stream before its chunks were written")
+	}
+	add(msgs[1])
+	if written != "abc" {
+		t.Fatalf("wrote %q", written)
+	}
+	if len(chunks.next) != 0 || len(chunks.pending) != 0 || len(chunks.expected) != 0 {
+		t.Fatalf("kept the stream once its chunks were written")
+	}
+}
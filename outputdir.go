@@ -0,0 +1,71 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// replaces anything but letters, digits, '.', '_' and '-' so a value submitted with a job is a single, harmless path element
+func SanitizePathElement(value string) string {
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, value)
+	if clean == "" || clean == "." || clean == ".." {
+		return "_"
+	}
+	return clean
+}
+
+// fills in the {jobid}, {owner}, {label}, {type} and {date} placeholders of an outputname template
+func OutputName(template string, jd JobDetails, created time.Time) string {
+	return strings.NewReplacer(
+		"{jobid}", SanitizePathElement(jd.JobId),
+		"{owner}", SanitizePathElement(jd.Owner),
+		"{label}", SanitizePathElement(jd.Label),
+		"{type}", SanitizePathElement(jd.Type),
+		"{date}", created.Format("2006-01-02")).Replace(template)
+}
+
+// directory a new job's files are written to: its outputname and requested subpath under outputroot, which it can't escape
+func JobOutputDir(jd JobDetails) string {
+	return SafeJoin(outputroot, path.Join(OutputName(outputname, jd, time.Now()), filepath.ToSlash(jd.OutputSubpath)))
+}
+
+// the uri the master serves a directory under outputroot at
+func OutputUri(dir string) string {
+	rel, err := filepath.Rel(outputroot, dir)
+	if err != nil || rel == "." {
+		return "/output/"
+	}
+	return "/output/" + filepath.ToSlash(rel) + "/"
+}
+
+// path of one of the job's files, such as its ".out.txt"
+func (this JobDetails) OutputFile(suffix string) string {
+	return filepath.Join(this.OutputDir, this.JobId+suffix)
+}
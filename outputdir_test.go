@@ -0,0 +1,73 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// with the default outputname a job's files are in outputroot/jobid, served at its OutputUri
+func TestDefaultOutputLayout(t *testing.T) {
+	if outputname != "{jobid}" {
+		t.Fatalf("default outputname %q", outputname)
+	}
+	root := outputroot
+	defer func() { outputroot = root }()
+	outputroot = t.TempDir()
+
+	jd := JobDetails{JobId: "A1B2C3"}
+	jd.OutputDir = JobOutputDir(jd)
+	if want := filepath.Join(outputroot, "A1B2C3"); jd.OutputDir != want {
+		t.Fatalf("OutputDir %v, want %v", jd.OutputDir, want)
+	}
+	uri := OutputUri(jd.OutputDir)
+	if uri != "/output/A1B2C3/" {
+		t.Fatalf("OutputUri %v", uri)
+	}
+
+	if err := os.MkdirAll(jd.OutputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(jd.OutputFile(".out.txt"), []byte("out\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.StripPrefix("/output/", NewOutputFileServer(outputroot)))
+	defer server.Close()
+	resp, err := http.Get(server.URL + uri + "A1B2C3.out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "out\n" {
+		t.Fatalf("%v: %q", resp.Status, body)
+	}
+}
+
+func TestOutputUriOfRoot(t *testing.T) {
+	if uri := OutputUri(outputroot); uri != "/output/" {
+		t.Fatalf("OutputUri %v", uri)
+	}
+}
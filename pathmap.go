@@ -0,0 +1,80 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rewrites paths starting with From to start with To
+type PathMapping struct {
+	From string
+	To   string
+}
+
+// an ordered list of path prefix rewrites, the first matching prefix wins
+type PathMap []PathMapping
+
+// parses a comma separated list of from:to prefix pairs such as "/net/data:/data, /net/ref:/ref"
+func ParsePathMap(value string) (pm PathMap, err error) {
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		fromto := strings.SplitN(pair, ":", 2)
+		if len(fromto) != 2 || fromto[0] == "" || fromto[1] == "" {
+			return nil, fmt.Errorf("invalid path mapping %q (expected from:to)", pair)
+		}
+		pm = append(pm, PathMapping{From: strings.TrimSpace(fromto[0]), To: strings.TrimSpace(fromto[1])})
+	}
+	return
+}
+
+// rewrites p if it is, or is inside, one of the mapped prefixes
+func (pm PathMap) Rewrite(p string) string {
+	for _, m := range pm {
+		from := strings.TrimSuffix(m.From, "/")
+		if p == from || strings.HasPrefix(p, from+"/") {
+			return strings.TrimSuffix(m.To, "/") + p[len(from):]
+		}
+	}
+	return p
+}
+
+// rewrites a command line argument that is a path or an option of the form name=path
+func (pm PathMap) RewriteArg(arg string) string {
+	if rewritten := pm.Rewrite(arg); rewritten != arg {
+		return rewritten
+	}
+	if i := strings.Index(arg, "="); i >= 0 {
+		return arg[:i+1] + pm.Rewrite(arg[i+1:])
+	}
+	return arg
+}
+
+func (pm PathMap) RewriteArgs(args []string) []string {
+	rewritten := make([]string, len(args))
+	for i, arg := range args {
+		rewritten[i] = pm.RewriteArg(arg)
+	}
+	return rewritten
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// version of the protocol between masters and workers spoken by this build. version 1 is the original set of
+// messages, sent by workers that give no version, version 2 adds the WELCOME reply and capabilities
+const protocolversion = 2
+
+// optional message types, sent only to a master or worker that listed the capability in its HELLO or WELCOME
+const (
+	CLEANUPCAPABILITY     = "cleanup"
+	CAPACITYCAPABILITY    = "capacity"
+	RESULTCAPABILITY      = "results"
+	TASKSTARTEDCAPABILITY = "taskstarted"
+	ACKCAPABILITY         = "ack"
+	BATCHCAPABILITY       = "batch" // frames holding several messages, see EncodeFrame
+)
+
+// the capability needed to send each optional message type, types not listed are always sent
+var messageCapabilities = map[int]string{
+	CLEANUP:     CLEANUPCAPABILITY,
+	CAPACITY:    CAPACITYCAPABILITY,
+	RESULT:      RESULTCAPABILITY,
+	TASKSTARTED: TASKSTARTEDCAPABILITY,
+	ACK:         ACKCAPABILITY,
+}
+
+// every capability this build has
+func AllCapabilities() []string {
+	rv := []string{BATCHCAPABILITY}
+	for _, c := range messageCapabilities {
+		rv = append(rv, c)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// the protocol of a worker running in the master's process, whose messages pass over channels in order and exactly
+// once so they need neither acknowledging nor batching
+func LocalProtocol() WelcomeMsgBody {
+	caps := NewCapabilities(AllCapabilities())
+	delete(caps, ACKCAPABILITY)
+	delete(caps, BATCHCAPABILITY)
+	return WelcomeMsgBody{ProtocolVersion: protocolversion, Capabilities: caps.List(), Session: Session()}
+}
+
+// capabilities both ends of a connection have
+type Capabilities map[string]bool
+
+// the capabilities of the other end this build also has
+func NewCapabilities(theirs []string) Capabilities {
+	ours := Capabilities{}
+	for _, c := range AllCapabilities() {
+		ours[c] = true
+	}
+	rv := Capabilities{}
+	for _, c := range theirs {
+		if ours[c] {
+			rv[c] = true
+		}
+	}
+	return rv
+}
+
+// true if a message of the given type may be sent
+func (this Capabilities) Allows(msgType int) bool {
+	c, isin := messageCapabilities[msgType]
+	return !isin || this[c]
+}
+
+func (this Capabilities) List() []string {
+	rv := []string{}
+	for c := range this {
+		rv = append(rv, c)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// body of the master's WELCOME reply to the HELLO of a worker speaking version 2 or later
+type WelcomeMsgBody struct {
+	ProtocolVersion int      // version the connection speaks, the older of the master's and the worker's
+	Capabilities    []string // those both have
+	Session         string   // changes when the master restarts
+	Received        uint64   // the last numbered message the master received from the worker
+}
+
+func NewWelcomeMsgBody(data string) (*WelcomeMsgBody, error) {
+	rv := &WelcomeMsgBody{}
+	err := json.Unmarshal([]byte(data), rv)
+	return rv, err
+}
+
+// checks the protocol of a worker saying hello, returns the master's reply or why the worker is refused
+func NegotiateProtocol(hello *HelloMsgBody) (WelcomeMsgBody, error) {
+	version := hello.ProtocolVersion
+	if version == 0 {
+		version = 1
+	}
+	if version < minprotocolversion {
+		return WelcomeMsgBody{}, fmt.Errorf("worker speaks protocol version %d, this master needs %d or later; upgrade the worker", version, minprotocolversion)
+	}
+	if version > protocolversion {
+		version = protocolversion
+	}
+	return WelcomeMsgBody{ProtocolVersion: version, Capabilities: NewCapabilities(hello.Capabilities).List(), Session: Session()}, nil
+}
+
+// replies to a worker's HELLO with the protocol agreed, or why it is refused
+func SendWelcome(ws *websocket.Conn, welcome WelcomeMsgBody, refused error) error {
+	msg := WorkerMessage{Type: WELCOME}
+	if refused != nil {
+		msg.ErrMsg = refused.Error()
+	}
+	if err := msg.BodyFromInterface(welcome); err != nil {
+		return err
+	}
+	msgjson, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = ws.Write(msgjson)
+	return err
+}
@@ -29,6 +29,8 @@ For programatic ussage see the doc strings of individual functions
 """
 
 import sys
+import os
+import shlex
 import httplib
 import urllib
 import urlparse
@@ -47,9 +49,12 @@ except ImportError:
     print "Error importing ssl module. Https will not be supported."
 
 
-usage = """Usage: golem.py [http://]hostname[:port] [-p password] [-L label] [-u email] command and args
+usage = """Usage: golem.py [http://]hostname[:port] [-p password] [-L label] [-u email] [-b bundle] [-a tags] [-f finalizer] command and args
 
 Hosts are assumed to be serving over https unless http is specified.
+A bundle (a script or .tar/.tar.gz of scripts) is sent with run and runlist jobs and unpacked on each worker.
+Tags (a comma separated list of task, host and time) are prefixed to each line of output of run and runlist jobs.
+A finalizer (a quoted command line) is run once after every task of a run or runlist job has finished or errored.
 
 Command and args can be:
 run n job_executable exeutable args : run job_executable n times with the supplied args
@@ -57,6 +62,7 @@ runlist listofjobs.txt              : run each line (n n job_executable exeutabl
 runerrors listofjobs.txt oldjobid   : rerun the tasks that errored during the old job
 rundnf listofjobs.txt oldjobid      : rerun the tasks that did not finish during the old job
 get jobid                           : Download the out, err, and log files for the specified job
+task jobid lineid taskid [stderr]   : print the stdout (or stderr) of a single task of the specified job
 list                                : list statuses of all submissions on cluster
 jobs                                : same as list
 status subid                        : get status of a single submission
@@ -70,7 +76,7 @@ restart                             : cycle all golem proccess on the cluster...
 die                                 : kill everything ... rarelly used
 """
 
-def runOneLine(count, args, pwd, url, loud=True, label="", email=""):
+def runOneLine(count, args, pwd, url, loud=True, label="", email="", bundle="", attribution="", finalizer=""):
     """
     Runs a single command on a specified Golem cluster.
     Parameters:
@@ -81,6 +87,9 @@ def runOneLine(count, args, pwd, url, loud=True, label="", email=""):
         label - optional header to label job
         email - optional email to indicate ownership
         loud - whether or not to print status messages on stdout. Defaults to True.
+        bundle - optional path of a script or tarball to send with the job
+        attribution - optional comma separated tags (task, host, time) to prefix each line of output with
+        finalizer - optional command line to run once after every task has finished or errored
     Returns:
         A 2-tuple of the Golem server's response number and the body of the response.
     Throws:
@@ -91,10 +100,10 @@ def runOneLine(count, args, pwd, url, loud=True, label="", email=""):
     data = {'command': "run"}
     if loud:
         print "Submitting run request to %s." % url
-    return doPost(url, data, jobs, pwd, loud, label, email)
+    return doPost(url, data, jobs, pwd, loud, label, email, bundle, attribution, finalizer)
 
 
-def runBatch(jobs, pwd, url, loud=True, label="", email=""):
+def runBatch(jobs, pwd, url, loud=True, label="", email="", bundle="", attribution="", finalizer=""):
     """
     Runs a Python list of jobs on the specified Golem cluster.
     Parameters:
@@ -106,6 +115,9 @@ def runBatch(jobs, pwd, url, loud=True, label="", email=""):
         label - optional header to label job
         email - optional email to indicate ownership
         loud - whether to print status messages on stdout. Defaults to True.
+        bundle - optional path of a script or tarball to send with the job
+        attribution - optional comma separated tags (task, host, time) to prefix each line of output with
+        finalizer - optional command line to run once after every task has finished or errored
     Returns:
         A 2-tuple of the Golem server's response number and the body of the response.
     Throws:
@@ -115,10 +127,10 @@ def runBatch(jobs, pwd, url, loud=True, label="", email=""):
     data = {'command': "runlist"}
     if loud:
         print "Submitting run request to %s." % url
-    return doPost(url, data, jobs, pwd, loud, label, email)
+    return doPost(url, data, jobs, pwd, loud, label, email, bundle, attribution, finalizer)
 
 
-def runList(fo, pwd, url, loud=True, label="", email=""):
+def runList(fo, pwd, url, loud=True, label="", email="", bundle="", attribution="", finalizer=""):
     """
     Interprets an open file as a runlist, then executes it on the specified Golem cluster.
     Parameters:
@@ -134,7 +146,7 @@ def runList(fo, pwd, url, loud=True, label="", email=""):
         Any failure of the HTTP channel will go uncaught.
     """
     jobs = generateJobList(fo)
-    return runBatch(jobs, pwd, url, loud, label, email)
+    return runBatch(jobs, pwd, url, loud, label, email, bundle, attribution, finalizer)
 
 
 def runOnEach(jobs, pwd, url, loud=True, label="", email=""):
@@ -316,9 +328,10 @@ class HTTPSTLSv1Connection(httplib.HTTPConnection):
             self.sock = ssl.wrap_socket(sock, self.key_file, self.cert_file, False, ssl.CERT_NONE, ssl.PROTOCOL_TLSv1)
 
 
-def encode_multipart_formdata(data, filebody):
-    """multipart encodes a form. data should be a dictionary of the the form fields and filebody
-    should be a string of the body of the file"""
+def encode_multipart_formdata(data, filebody, bundle="", finalizer=""):
+    """multipart encodes a form. data should be a dictionary of the the form fields, filebody
+    should be a string of the body of the file, bundle the optional path of a file to attach and
+    finalizer the optional json of the task to run after the others"""
     BOUNDARY = '----------ThIs_Is_tHe_bouNdaRY_$'
     CRLF = '\r\n'
     L = []
@@ -333,6 +346,20 @@ def encode_multipart_formdata(data, filebody):
         L.append('Content-Type: text/plain')
         L.append('')
         L.append(filebody)
+    if finalizer != "":
+        L.append('--' + BOUNDARY)
+        L.append('Content-Disposition: form-data; name="finalizer"; filename="finalizer.json"')
+        L.append('Content-Type: text/plain')
+        L.append('')
+        L.append(finalizer)
+    if bundle != "":
+        fo = open(bundle, "rb")
+        L.append('--' + BOUNDARY)
+        L.append('Content-Disposition: form-data; name="bundle"; filename="%s"' % os.path.basename(bundle))
+        L.append('Content-Type: application/octet-stream')
+        L.append('')
+        L.append(fo.read())
+        fo.close()
     L.append('--' + BOUNDARY + '--')
     L.append('')
     body = CRLF.join(L)
@@ -372,15 +399,19 @@ def doGet(url, loud=True):
     #conn.close()
 
 
-def doPost(url, paramMap, jsondata, password, loud=True, label="", email=""):
+def doPost(url, paramMap, jsondata, password, loud=True, label="", email="", bundle="", attribution="", finalizer=""):
     """
     posts a multipart form to url, paramMap should be a dictionary of the form fields, json data
-    should be a string of the body of the file (json in our case) and password should be the password
-    to include in the header
+    should be a string of the body of the file (json in our case), password should be the password
+    to include in the header, bundle the optional path of a script or tarball to send with the job,
+    attribution the optional tags to prefix each line of output with and finalizer the optional
+    command line to run once after every task has finished or errored
     """
 
     u = urlparse.urlparse(url)
-    content_type, body = encode_multipart_formdata(paramMap, jsondata)
+    if finalizer != "":
+        finalizer = json.dumps({"Count": 1, "Args": shlex.split(finalizer)})
+    content_type, body = encode_multipart_formdata(paramMap, jsondata, bundle, finalizer)
     headers = {"Content-type": content_type,
         'content-length': str(len(body)),
         "Accept": "text/plain",
@@ -388,6 +419,8 @@ def doPost(url, paramMap, jsondata, password, loud=True, label="", email=""):
         "x-golem-job-label": label,
         "x-golem-job-owner": email
     }
+    if attribution != "":
+        headers["x-golem-job-attribution"] = attribution
 
     if loud:
         print "scheme: %s host: %s port: %s" % (u.scheme, u.hostname, u.port)
@@ -443,20 +476,68 @@ def generateJobList(fo):
         values = line.split()
         yield {"Count": int(values[0]), "Args": values[1:]}
 
+def getOutputUrl(url, jobId):
+    """URL of the directory the master wrote the job's files to, taken from the OutputUri at /jobs/jobId.
+    Masters that don't report it write every job's files to output/ itself"""
+    resp, output = doGet(url+"jobs/"+jobId, False)
+    if output is not None:
+        try:
+            uri = json.loads(output).get("OutputUri", "")
+        except ValueError:
+            uri = ""
+        if uri != "":
+            return url + uri.lstrip("/")
+    return url+"output/"
+
 def getOut(url, jobId):
     """Gets out, err and log for the specified job"""
-    for t in ["log","err","out"]:
+    outurl = getOutputUrl(url, jobId)
+    for fn in [jobId+".log.jsonl", jobId+".log.txt"]:
+        resp, output = doGet(outurl+fn, False)
+        if output is not None:
+            fo = open(fn, "wb")
+            fo.write(output)
+            fo.close()
+    for t in ["err","out"]:
         fn = jobId+"."+t+".txt" 
-        fileurl = url+"output/"+fn
+        fileurl = outurl+fn
         urllib.urlretrieve (fileurl, fn)
 
     
 
+def getTaskOutput(url, jobId, lineId, taskId, stream="stdout"):
+    """Prints the stdout or stderr written by a single task of the specified job"""
+    resp, output = doGet(url + "%s/tasks/%s/%s/%s" % (jobId, lineId, taskId, stream), False)
+    if output is None:
+        print resp.status, resp.reason
+    else:
+        sys.stdout.write(output)
+    return resp, output
+
+
 def getLog(url, jobId):
-    """Gets logs for a jobId and parsed them into finished and failed hashes by (int) line number"""
+    """Gets logs for a jobId and parsed them into finished and failed hashes by (int) line number,
+    from the json log or, for masters set to write text logs, the text log"""
     failed = {}
     finished = {}
-    logurl = url+"output/"+jobId+".log.txt"
+    outurl = getOutputUrl(url, jobId)
+    logurl = outurl+jobId+".log.jsonl"
+    print logurl
+    resp = doGet(logurl, False)
+    if resp[1] is not None:
+        for line in resp[1].split("\n"):
+            if line.strip() == "":
+                continue
+            event = json.loads(line)
+            if event["Finalizer"]:
+                continue
+            if event["Event"] in ["errored", "killed"]:
+                failed[event["LineId"]]=True
+            if event["Event"]=="finished":
+                finished[event["LineId"]]=True
+        return finished, failed
+
+    logurl = outurl+jobId+".log.txt"
     print logurl
     resp = doGet(logurl, False)
     for line in resp[1].split("\n"):
@@ -464,7 +545,7 @@ def getLog(url, jobId):
         if len(vs)>1 and vs[0]=="ERRORED":
             failed[int(vs[3])]=True
         if len(vs)>1 and vs[0]=="FINISHED":
-            finished[int()]=True
+            finished[int(vs[3])]=True
     return finished, failed
 
 
@@ -526,6 +607,9 @@ def main():
     pwd = ""
     label = ""
     email = ""
+    bundle = ""
+    attribution = ""
+    finalizer = ""
     nonflags = []
     flags = True
     #TODO: abstract and automate printing of ussage
@@ -541,6 +625,18 @@ def main():
         elif flags == True and sys.argv[commandIndex] == "-u":
             email = sys.argv[commandIndex + 1]
             commandIndex = commandIndex + 2
+
+        elif flags == True and sys.argv[commandIndex] == "-b":
+            bundle = sys.argv[commandIndex + 1]
+            commandIndex = commandIndex + 2
+
+        elif flags == True and sys.argv[commandIndex] == "-a":
+            attribution = sys.argv[commandIndex + 1]
+            commandIndex = commandIndex + 2
+
+        elif flags == True and sys.argv[commandIndex] == "-f":
+            finalizer = sys.argv[commandIndex + 1]
+            commandIndex = commandIndex + 2
         else:
             flags = False
             nonflags.append(sys.argv[commandIndex])
@@ -553,10 +649,10 @@ def main():
     try:
         cmd = nonflags[0].lower()
         if cmd == "run":
-            runOneLine(int(nonflags[1]), nonflags[2:], pwd, url, True, label, email)
+            runOneLine(int(nonflags[1]), nonflags[2:], pwd, url, True, label, email, bundle, attribution, finalizer)
         elif cmd == "runlist":
             fo = open(nonflags[1])
-            runList(fo, pwd, url, True, label, email)
+            runList(fo, pwd, url, True, label, email, bundle, attribution, finalizer)
             fo.close()
         elif cmd == "rundnf":
             fo = open(nonflags[1])
@@ -568,6 +664,11 @@ def main():
             fo.close()
         elif cmd == "get":
             getOut(url[:-5], nonflags[1])
+        elif cmd == "task":
+            stream = "stdout"
+            if len(nonflags) > 4:
+                stream = nonflags[4]
+            getTaskOutput(url, nonflags[1], nonflags[2], nonflags[3], stream)
         elif cmd == "runoneach":
             jobs = [{"Args": nonflags[1]}]
             runOnEach(jobs, pwd, url, True, label, email)
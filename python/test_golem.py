@@ -0,0 +1,98 @@
+#!/usr/bin/env python
+#    Copyright (C) 2003-2010 Institute for Systems Biology
+#                            Seattle, Washington, USA.
+#
+#    This library is free software; you can redistribute it and/or
+#    modify it under the terms of the GNU Lesser General Public
+#    License as published by the Free Software Foundation; either
+#    version 2.1 of the License, or (at your option) any later version.
+#
+#    This library is distributed in the hope that it will be useful,
+#    but WITHOUT ANY WARRANTY; without even the implied warranty of
+#    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+#    Lesser General Public License for more details.
+#
+#    You should have received a copy of the GNU Lesser General Public
+#    License along with this library; if not, write to the Free Software
+#    Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+#
+#
+"""
+Tests golem.py against a stand-in master serving a job's files in the default layout, output/jobid/jobid.*
+
+Run with python test_golem.py
+"""
+import BaseHTTPServer
+import json
+import os
+import shutil
+import tempfile
+import threading
+import unittest
+
+import golem
+
+JOBID = "A1B2C3"
+
+FILES = {
+    "/jobs/" + JOBID: json.dumps({"JobId": JOBID, "OutputUri": "/output/" + JOBID + "/"}),
+    "/output/%s/%s.log.jsonl" % (JOBID, JOBID): "\n".join([
+        json.dumps({"Event": "finished", "LineId": 0, "Finalizer": False}),
+        json.dumps({"Event": "errored", "LineId": 1, "Finalizer": False}),
+    ]) + "\n",
+    "/output/%s/%s.out.txt" % (JOBID, JOBID): "out\n",
+    "/output/%s/%s.err.txt" % (JOBID, JOBID): "err\n",
+}
+
+
+class FakeMaster(BaseHTTPServer.BaseHTTPRequestHandler):
+    def do_GET(self):
+        body = FILES.get(self.path)
+        if body is None:
+            self.send_error(404)
+            return
+        self.send_response(200)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, *args):
+        pass
+
+
+class DefaultLayoutTest(unittest.TestCase):
+    def setUp(self):
+        self.server = BaseHTTPServer.HTTPServer(("127.0.0.1", 0), FakeMaster)
+        threading.Thread(target=self.server.serve_forever).start()
+        self.url = "http://127.0.0.1:%d/" % self.server.server_address[1]
+        self.cwd = os.getcwd()
+        self.dir = tempfile.mkdtemp()
+        os.chdir(self.dir)
+
+    def tearDown(self):
+        os.chdir(self.cwd)
+        shutil.rmtree(self.dir)
+        self.server.shutdown()
+        self.server.server_close()
+
+    def test_output_url(self):
+        self.assertEqual(golem.getOutputUrl(self.url, JOBID), self.url + "output/" + JOBID + "/")
+
+    def test_older_master(self):
+        self.assertEqual(golem.getOutputUrl(self.url, "unknown"), self.url + "output/")
+
+    def test_get_log(self):
+        finished, failed = golem.getLog(self.url, JOBID)
+        self.assertEqual(finished, {0: True})
+        self.assertEqual(failed, {1: True})
+
+    def test_get_out(self):
+        golem.getOut(self.url, JOBID)
+        for suffix, text in [(".out.txt", "out\n"), (".err.txt", "err\n"), (".log.jsonl", None)]:
+            self.assertTrue(os.path.exists(JOBID + suffix))
+            if text is not None:
+                self.assertEqual(open(JOBID + suffix).read(), text)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -21,9 +21,39 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
 )
 
+// the response to a GET of a rest resource, whose Find is only given the response writer, along with its request so
+// a response that keeps streaming can tell when the client has gone away
+type RequestResponse struct {
+	http.ResponseWriter
+	Request *http.Request
+}
+
+func (this RequestResponse) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (this RequestResponse) Unwrap() http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+// serves mux, usually the http.DefaultServeMux that the rest resources are registered with, giving GETs of jobs a
+// RequestResponse. other requests keep the server's own response writer, which web sockets hijack
+func WithRequests(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/jobs/") {
+			rw = RequestResponse{rw, r}
+		}
+		mux.ServeHTTP(rw, r)
+	})
+}
+
 func GetHeader(r *http.Request, headerName string, defaultValue string) string {
 	logger.Debug("GetHeader(%v,%v,%v)", r.URL.Path, headerName, defaultValue)
 	val := r.Header.Get(headerName)
@@ -36,19 +66,19 @@ func GetHeader(r *http.Request, headerName string, defaultValue string) string {
 func LoadTasksFromJson(r *http.Request, tasks *[]Task) (err error) {
 	logger.Debug("LoadTasksFromJson(%v)", r.URL.Path)
 
-	mpreader, err := r.MultipartReader()
-	if err != nil {
+	//parsed into r.MultipartForm so other parts (like a job bundle) can be read afterwards
+	if err = r.ParseMultipartForm(10000); err != nil {
 		logger.Warn(err)
 		return
 	}
 
-	frm, err := mpreader.ReadForm(10000)
-	if err != nil {
+	if len(r.MultipartForm.File["jsonfile"]) == 0 {
+		err = errors.New("jsonfile required in form")
 		logger.Warn(err)
 		return
 	}
 
-	jsonfile, err := frm.File["jsonfile"][0].Open()
+	jsonfile, err := r.MultipartForm.File["jsonfile"][0].Open()
 	if err != nil {
 		logger.Warn(err)
 		return
@@ -58,6 +88,41 @@ func LoadTasksFromJson(r *http.Request, tasks *[]Task) (err error) {
 	err = json.NewDecoder(jsonfile).Decode(&tasks)
 	if err != nil {
 		logger.Warn(err)
+		return
+	}
+
+	for _, task := range *tasks {
+		if err = task.Validate(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// reads the optional "finalizer" file of a job submission, a single task in json
+func LoadFinalizerFromJson(r *http.Request) (finalizer *Task, err error) {
+	logger.Debug("LoadFinalizerFromJson(%v)", r.URL.Path)
+	if r.MultipartForm == nil || len(r.MultipartForm.File["finalizer"]) == 0 {
+		return
+	}
+
+	jsonfile, err := r.MultipartForm.File["finalizer"][0].Open()
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	defer jsonfile.Close()
+
+	finalizer = &Task{}
+	if err = json.NewDecoder(jsonfile).Decode(finalizer); err != nil {
+		logger.Warn(err)
+		return nil, err
+	}
+	if finalizer.Count > 1 {
+		return nil, errors.New("a finalizer runs once, its Count can't be more than 1")
+	}
+	if err = finalizer.Validate(); err != nil {
+		return nil, err
 	}
 	return
 }
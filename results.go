@@ -0,0 +1,145 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// the longest record a task may write to its result channel
+const maxresultbytes = 1 << 20
+
+// a JSON record a task wrote to its result channel, tagged with the task
+type TaskResult struct {
+	LineId  int
+	TaskId  int
+	Attempt int
+	Result  json.RawMessage
+}
+
+type TaskResultList struct {
+	Items         []TaskResult
+	NumberOfItems int
+}
+
+// forwards each line a task writes to its result channel (file descriptor 3, also named by GOLEM_RESULT) to the master.
+// a line that isn't valid JSON goes to the task's stderr instead
+func PipeResultsToChan(r io.Reader, job *WorkerJob, ch chan WorkerMessage, done chan int) {
+	logger.Debug("PipeResultsToChan(%v)", job.Key())
+	defer func() {
+		done <- 1
+	}()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxresultbytes)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		msg := WorkerMessage{Type: RESULT, SubId: job.SubId, LineId: job.LineId, JobId: job.JobId, Attempt: job.Attempt, Body: string(line)}
+		if !json.Valid(line) {
+			msg.Type = CERROR
+			msg.Body = fmt.Sprintf("invalid result from task %v: %s\n", job.Key(), line)
+		}
+		blocked := true
+		for blocked == true {
+			select {
+			case ch <- msg:
+				blocked = false
+			case <-time.After(time.Second):
+				logger.Printf("WARNING PipeResultsToChan() has been blocked for more then 1 second id:%v", job.SubId)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Warn(err)
+		//keep the task from blocking on a result channel nobody reads
+		io.Copy(ioutil.Discard, r)
+	}
+}
+
+// reads the results a job's tasks wrote, written one JSON TaskResult per line
+func ReadResults(r io.Reader) ([]TaskResult, error) {
+	results := []TaskResult{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 2*maxresultbytes)
+	for scanner.Scan() {
+		var result TaskResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, scanner.Err()
+}
+
+// parses the optional lineid and taskid following /jobs/id/results, -1 matches any
+func ParseResultFilter(parts []string) (lineId int, taskId int, err error) {
+	lineId, taskId = -1, -1
+	if len(parts) > 4 {
+		err = fmt.Errorf("GET /jobs/id/results[/lineid[/taskid]]")
+		return
+	}
+	if len(parts) > 2 {
+		if lineId, err = strconv.Atoi(parts[2]); err != nil {
+			return
+		}
+	}
+	if len(parts) > 3 {
+		taskId, err = strconv.Atoi(parts[3])
+	}
+	return
+}
+
+// keeps only the results of each task's latest attempt, earlier attempts were lost with their worker
+func LatestResults(results []TaskResult) []TaskResult {
+	type task struct{ lineId, taskId int }
+	latest := map[task]int{}
+	for _, result := range results {
+		t := task{result.LineId, result.TaskId}
+		if attempt, isin := latest[t]; !isin || result.Attempt > attempt {
+			latest[t] = result.Attempt
+		}
+	}
+	kept := []TaskResult{}
+	for _, result := range results {
+		if result.Attempt == latest[task{result.LineId, result.TaskId}] {
+			kept = append(kept, result)
+		}
+	}
+	return kept
+}
+
+func FilterResults(results []TaskResult, lineId int, taskId int) []TaskResult {
+	matching := []TaskResult{}
+	for _, result := range results {
+		if (lineId < 0 || result.LineId == lineId) && (taskId < 0 || result.TaskId == taskId) {
+			matching = append(matching, result)
+		}
+	}
+	return matching
+}
@@ -0,0 +1,278 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// output is uploaded to object stores in parts of this size
+const s3partsize = 8 << 20
+
+// writes files to an S3 compatible object store, such as a local MinIO server, with requests signed by AWS signature
+// version 4. objects are addressed path style (endpoint/bucket/key) and credentials are taken from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and the optional AWS_SESSION_TOKEN
+type S3Sink struct {
+	Endpoint     string
+	Region       string
+	Bucket       string
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// parses s3://bucket/prefix with the optional parameters endpoint (defaults to the AWS endpoint of the region) and region (defaults to us-east-1)
+func NewS3Sink(value string) (*S3Sink, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid output sink %q (expected s3://bucket/prefix)", value)
+	}
+	sink := &S3Sink{
+		Endpoint: u.Query().Get("endpoint"), Region: u.Query().Get("region"),
+		Bucket: u.Host, Prefix: strings.Trim(u.Path, "/"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"), SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), SessionToken: os.Getenv("AWS_SESSION_TOKEN")}
+	if sink.Region == "" {
+		sink.Region = "us-east-1"
+	}
+	if sink.Endpoint == "" {
+		sink.Endpoint = "https://s3." + sink.Region + ".amazonaws.com"
+	}
+	sink.Endpoint = strings.TrimSuffix(sink.Endpoint, "/")
+	return sink, nil
+}
+
+func (this *S3Sink) Create(fpath string) (io.WriteCloser, error) {
+	return &S3Upload{sink: this, key: path.Join(this.Prefix, OutputKey(fpath))}, nil
+}
+
+// sends a signed request for the object key and returns the response if it succeeded
+func (this *S3Sink) Do(method string, key string, query url.Values, body []byte) (*http.Response, []byte, error) {
+	u := this.Endpoint + S3Escape("/"+this.Bucket+"/"+key, false)
+	if len(query) > 0 {
+		u += "?" + S3Query(query)
+	}
+	r, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	this.Sign(r, body, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	rbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, nil, fmt.Errorf("%v %v: %v %s", method, key, resp.Status, rbody)
+	}
+	return resp, rbody, nil
+}
+
+// adds the x-amz-date, x-amz-content-sha256 and Authorization headers of AWS signature version 4
+func (this *S3Sink) Sign(r *http.Request, body []byte, now time.Time) {
+	payloadHash := fmt.Sprintf("%x", sha256.Sum256(body))
+	amzdate := now.Format("20060102T150405Z")
+	r.Header.Set("x-amz-date", amzdate)
+	r.Header.Set("x-amz-content-sha256", payloadHash)
+	if this.SessionToken != "" {
+		r.Header.Set("x-amz-security-token", this.SessionToken)
+	}
+
+	headers := map[string]string{"host": r.URL.Host}
+	for name := range r.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(r.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := now.Format("20060102") + "/" + this.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest)))
+
+	key := []byte("AWS4" + this.SecretKey)
+	for _, part := range []string{now.Format("20060102"), this.Region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", this.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// percent encodes everything but unreserved characters, and slashes unless encodeSlash, as signature version 4 requires
+func S3Escape(s string, encodeSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// the canonical query string, sorted by name
+func S3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := []string{}
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, S3Escape(name, true)+"="+S3Escape(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+// an object being written to an S3Sink. small objects are sent with one PUT when closed, larger ones as a multipart
+// upload started once the first part is full
+type S3Upload struct {
+	sink     *S3Sink
+	key      string
+	buf      bytes.Buffer
+	uploadId string
+	parts    []s3Part
+	err      error
+}
+
+func (u *S3Upload) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+	u.buf.Write(p)
+	for u.buf.Len() >= s3partsize {
+		if u.err = u.UploadPart(u.buf.Next(s3partsize)); u.err != nil {
+			u.Abort()
+			return 0, u.err
+		}
+	}
+	return len(p), nil
+}
+
+func (u *S3Upload) UploadPart(data []byte) error {
+	if u.uploadId == "" {
+		_, body, err := u.sink.Do("POST", u.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var initiated struct {
+			UploadId string
+		}
+		if err := xml.Unmarshal(body, &initiated); err != nil {
+			return err
+		}
+		u.uploadId = initiated.UploadId
+	}
+
+	number := len(u.parts) + 1
+	resp, _, err := u.sink.Do("PUT", u.key, url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {u.uploadId}}, data)
+	if err != nil {
+		return err
+	}
+	u.parts = append(u.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+// gives up on a multipart upload so the store can discard its parts
+func (u *S3Upload) Abort() {
+	if u.uploadId == "" {
+		return
+	}
+	if _, _, err := u.sink.Do("DELETE", u.key, url.Values{"uploadId": {u.uploadId}}, nil); err != nil {
+		logger.Warn(err)
+	}
+}
+
+func (u *S3Upload) Close() error {
+	if u.err != nil {
+		return u.err
+	}
+	if u.uploadId == "" {
+		_, _, u.err = u.sink.Do("PUT", u.key, nil, u.buf.Bytes())
+		return u.err
+	}
+
+	if u.buf.Len() > 0 {
+		if u.err = u.UploadPart(u.buf.Bytes()); u.err != nil {
+			u.Abort()
+			return u.err
+		}
+	}
+	complete, err := xml.Marshal(s3CompleteMultipartUpload{Parts: u.parts})
+	if err == nil {
+		_, _, err = u.sink.Do("POST", u.key, url.Values{"uploadId": {u.uploadId}}, complete)
+	}
+	if err != nil {
+		u.Abort()
+	}
+	u.err = err
+	return err
+}
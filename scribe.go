@@ -65,6 +65,9 @@ func MonitorClusterStats(store JobStore, target string, numberOfSeconds int64) {
 		for _, wn := range workerNodes {
 			totalWorkersRunning += wn.RunningJobs
 			totalWorkersAvailable += (wn.MaxJobs - wn.RunningJobs)
+			if err := s.store.SnapshotNode(NewNodeStat(wn)); err != nil {
+				logger.Warn(err)
+			}
 		}
 
 		logger.Debug("MonitorClusterStats [%d,%d,%d,%d]", totalJobsRunning, totalJobsPending, totalWorkersRunning, totalWorkersAvailable)
@@ -79,6 +82,7 @@ func (this *Scribe) PollJobs() {
 	logger.Debug("PollJobs")
 	for _, jd := range this.GetJobs() {
 		this.store.Update(jd)
+		this.SaveResults(jd)
 		this.ArchiveJob(jd)
 	}
 
@@ -160,6 +164,24 @@ func (this *Scribe) PostJob(jd JobDetails) (err error) {
 	if jd.Type != "" {
 		r.Header.Set("x-golem-job-type", jd.Type)
 	}
+	if jd.Attribution != "" {
+		r.Header.Set("x-golem-job-attribution", jd.Attribution)
+	}
+	if jd.OutputFiles != "" {
+		r.Header.Set("x-golem-job-output-files", jd.OutputFiles)
+	}
+	if jd.Compression != "" {
+		r.Header.Set("x-golem-job-compression", jd.Compression)
+	}
+	if limits := jd.OutputLimits.String(); limits != "" {
+		r.Header.Set("x-golem-job-output-limits", limits)
+	}
+	if jd.OutputSink != "" {
+		r.Header.Set("x-golem-job-output-sink", jd.OutputSink)
+	}
+	if jd.OutputSubpath != "" {
+		r.Header.Set("x-golem-job-output-subpath", jd.OutputSubpath)
+	}
 
 	go func() {
 		logger.Debug("encoding tasks")
@@ -167,6 +189,12 @@ func (this *Scribe) PostJob(jd JobDetails) (err error) {
 		if err := json.NewEncoder(jsonFileWriter).Encode(tasks); err != nil {
 			logger.Warn(err)
 		}
+		if jd.Finalizer != nil {
+			finalizerWriter, _ := multipartWriter.CreateFormFile("finalizer", "finalizer.json")
+			if err := json.NewEncoder(finalizerWriter).Encode(jd.Finalizer); err != nil {
+				logger.Warn(err)
+			}
+		}
 
 		multipartWriter.Close()
 		pwriter.Close()
@@ -189,6 +217,37 @@ func (this *Scribe) PostJob(jd JobDetails) (err error) {
 	return
 }
 
+// copies the results of a completed job from the master into the store, once even if it has none
+func (this *Scribe) SaveResults(jd JobDetails) (err error) {
+	if jd.State != COMPLETE {
+		return
+	}
+	if stored, err := this.store.Get(jd.JobId); err != nil || stored.ResultsSaved {
+		return err
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%v/jobs/%v/results", this.masterUrl, jd.JobId))
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Debug("SaveResults(%v): %v", jd.JobId, resp.Status)
+		return
+	}
+
+	lst := TaskResultList{}
+	if err = json.NewDecoder(resp.Body).Decode(&lst); err != nil {
+		logger.Warn(err)
+		return
+	}
+	if err = this.store.SaveResults(jd.JobId, lst.Items); err != nil {
+		logger.Warn(err)
+	}
+	return
+}
+
 func (this *Scribe) ArchiveJob(jd JobDetails) (err error) {
 	logger.Debug("ArchiveJob(%v)", jd)
 	if jd.State != COMPLETE {
@@ -0,0 +1,71 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// keeps the jobs and results the scribe saves in memory, other methods aren't used
+type resultStore struct {
+	JobStore
+	jobs    map[string]JobDetails
+	results map[string][]TaskResult
+}
+
+func (this *resultStore) Get(jobId string) (JobDetails, error) {
+	return this.jobs[jobId], nil
+}
+
+func (this *resultStore) SaveResults(jobId string, results []TaskResult) error {
+	this.results[jobId] = results
+	jd := this.jobs[jobId]
+	jd.ResultsSaved = true
+	this.jobs[jobId] = jd
+	return nil
+}
+
+// a completed job without results is fetched from the master once, not on every poll
+func TestSaveResultsWithoutResults(t *testing.T) {
+	fetched := 0
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		json.NewEncoder(w).Encode(TaskResultList{Items: []TaskResult{}})
+	}))
+	defer master.Close()
+
+	jd := JobDetails{JobId: "A1B2C3", State: COMPLETE}
+	store := &resultStore{jobs: map[string]JobDetails{jd.JobId: jd}, results: map[string][]TaskResult{}}
+	s := Scribe{store: store, masterUrl: master.URL}
+	for i := 0; i < 3; i++ {
+		if err := s.SaveResults(jd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetched != 1 {
+		t.Fatalf("results fetched %d times, expected once", fetched)
+	}
+	if _, saved := store.results[jd.JobId]; !saved {
+		t.Fatal("the empty results weren't saved")
+	}
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// where a job's output, log and index files are written. paths are those the files would have on the master,
+// inside outputroot, sinks writing elsewhere use the path relative to outputroot as the file's name
+type OutputSink interface {
+	Create(fpath string) (io.WriteCloser, error)
+}
+
+// a sink that can add to a file it created earlier
+type OutputAppender interface {
+	Append(fpath string) (io.WriteCloser, error)
+}
+
+// writes to the master's filesystem, the default
+type LocalSink struct{}
+
+func (LocalSink) Create(fpath string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(fpath)
+}
+
+func (LocalSink) Append(fpath string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// the slash separated name of a file in outputroot used by sinks that write elsewhere
+func OutputKey(fpath string) string {
+	rel, err := filepath.Rel(outputroot, fpath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(fpath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// streams each file as the body of a POST to the sink's url followed by the file's name
+type HttpSink struct {
+	Url string
+}
+
+func (this HttpSink) Create(fpath string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	r, err := http.NewRequest("POST", strings.TrimSuffix(this.Url, "/")+"/"+OutputKey(fpath), pr)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/octet-stream")
+
+	upload := &HttpUpload{pw: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := http.DefaultClient.Do(r)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("POST %v: %v", r.URL, resp.Status)
+			}
+		}
+		//writes fail instead of blocking once the request is over
+		pr.CloseWithError(err)
+		upload.done <- err
+	}()
+	return upload, nil
+}
+
+// a file being posted to an HttpSink, closing it finishes the request
+type HttpUpload struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (u *HttpUpload) Write(p []byte) (int, error) {
+	return u.pw.Write(p)
+}
+
+func (u *HttpUpload) Close() error {
+	u.pw.Close()
+	return <-u.done
+}
+
+// creates a sink from a url, http and https urls make an HttpSink and s3 urls an S3Sink
+func NewOutputSink(value string) (OutputSink, error) {
+	switch {
+	case strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://"):
+		return HttpSink{Url: value}, nil
+	case strings.HasPrefix(value, "s3://"):
+		return NewS3Sink(value)
+	}
+	return nil, fmt.Errorf("invalid output sink %q (expected an http, https or s3 url)", value)
+}
+
+// true if the named sink writes files to the master's disk, where a finalizer can read them
+func LocalOutputSink(name string) bool {
+	sink, err := GetOutputSink(name)
+	if err != nil {
+		return false
+	}
+	_, local := sink.(LocalSink)
+	return local
+}
+
+// returns the sink registered under name, "local" unless configured otherwise
+func GetOutputSink(name string) (OutputSink, error) {
+	if name == "" {
+		name = "local"
+	}
+	sink, isin := outputsinks[name]
+	if !isin {
+		return nil, fmt.Errorf("unknown output sink %q", name)
+	}
+	return sink, nil
+}
@@ -0,0 +1,328 @@
+/*
+   Copyright (C) 2003-2011 Institute for Systems Biology
+                           Seattle, Washington, USA.
+
+   This library is free software; you can redistribute it and/or
+   modify it under the terms of the GNU Lesser General Public
+   License as published by the Free Software Foundation; either
+   version 2.1 of the License, or (at your option) any later version.
+
+   This library is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+   Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public
+   License along with this library; if not, write to the Free Software
+   Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA 02111-1307  USA
+
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const checksumHeader = "x-golem-sha256"
+
+// joins a slash separated relative path onto root without allowing it to escape root
+func SafeJoin(root string, rel string) string {
+	return filepath.Join(root, filepath.FromSlash(path.Clean("/"+rel)))
+}
+
+// directory in the job's output directory that staged outputs of a task are written to
+func StagedOutputDir(dir string, subId string, lineId int, jobId int) string {
+	return filepath.Join(dir, subId+".output", strconv.Itoa(lineId), strconv.Itoa(jobId))
+}
+
+// scratch directory on the worker that a task with staged files runs in
+func TaskDir(job *WorkerJob) string {
+	return filepath.Join(scratchdir, "golem", job.SubId, fmt.Sprintf("%d.%d", job.LineId, job.JobId))
+}
+
+// computes the hex encoded sha256 checksum and size of a local file
+func FileChecksum(fpath string) (sum string, size int64, err error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if size, err = io.Copy(h, f); err != nil {
+		return
+	}
+	sum = fmt.Sprintf("%x", h.Sum(nil))
+	return
+}
+
+// serves staged input files to workers and receives staged output files from them
+type StageController struct {
+	master *Master
+	apikey string
+}
+
+// GET /stage/in/path, GET /stage/bundle/hash or PUT /stage/out/jobid/lineid/taskid/path
+func (this StageController) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	logger.Debug("ServeHTTP(%v %v)", r.Method, r.URL.Path)
+	if CheckApiKey(this.apikey, r) == false {
+		http.Error(rw, "api key required in header", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/stage/in/"):
+		rel := strings.TrimPrefix(r.URL.Path, "/stage/in/")
+		this.SendFile(rw, SafeJoin(stagedir, rel), rel)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/stage/bundle/"):
+		hash := strings.TrimPrefix(r.URL.Path, "/stage/bundle/")
+		this.SendFile(rw, BundlePath(hash), hash)
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/stage/out/"):
+		this.ReceiveOutput(rw, r, strings.TrimPrefix(r.URL.Path, "/stage/out/"))
+	default:
+		http.Error(rw, "GET /stage/in/path, GET /stage/bundle/hash or PUT /stage/out/jobid/lineid/taskid/path", http.StatusNotImplemented)
+	}
+}
+
+// streams a staged file, the checksum is sent as a trailer once the body is written
+func (this StageController) SendFile(rw http.ResponseWriter, fpath string, rel string) {
+	logger.Debug("SendFile(%v)", fpath)
+	f, err := os.Open(fpath)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.Error(rw, "not a file: "+rel, http.StatusNotFound)
+		return
+	}
+	if fi.Size() > stagemaxbytes {
+		http.Error(rw, fmt.Sprintf("%v is larger than %d bytes", rel, stagemaxbytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	h := sha256.New()
+	rw.Header().Set("Trailer", checksumHeader)
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(io.MultiWriter(rw, h), f); err != nil {
+		logger.Warn(err)
+		return
+	}
+	rw.Header().Set(checksumHeader, fmt.Sprintf("%x", h.Sum(nil)))
+}
+
+// writes an uploaded task output under the job's output directory after checking its size and checksum
+func (this StageController) ReceiveOutput(rw http.ResponseWriter, r *http.Request, rel string) {
+	logger.Debug("ReceiveOutput(%v)", rel)
+	parts := strings.SplitN(rel, "/", 4)
+	if len(parts) < 4 || parts[3] == "" {
+		http.Error(rw, "PUT /stage/out/jobid/lineid/taskid/path", http.StatusBadRequest)
+		return
+	}
+
+	subId := parts[0]
+	sub := this.master.GetSub(subId)
+	if sub == nil {
+		http.Error(rw, "job "+subId+" not found", http.StatusNotFound)
+		return
+	}
+
+	lineId, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jobId, err := strconv.Atoi(parts[2])
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	expected := r.Header.Get(checksumHeader)
+	if expected == "" {
+		http.Error(rw, checksumHeader+" required in header", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > stagemaxbytes {
+		http.Error(rw, fmt.Sprintf("%v is larger than %d bytes", parts[3], stagemaxbytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	fpath := SafeJoin(StagedOutputDir(sub.SniffDetails().OutputDir, subId, lineId, jobId), parts[3])
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	partial := fpath + ".part"
+	f, err := os.Create(partial)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r.Body, stagemaxbytes+1))
+	f.Close()
+
+	switch {
+	case err != nil:
+		os.Remove(partial)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	case n > stagemaxbytes:
+		os.Remove(partial)
+		http.Error(rw, fmt.Sprintf("%v is larger than %d bytes", parts[3], stagemaxbytes), http.StatusRequestEntityTooLarge)
+	case fmt.Sprintf("%x", h.Sum(nil)) != expected:
+		os.Remove(partial)
+		http.Error(rw, "checksum mismatch for "+parts[3], http.StatusBadRequest)
+	default:
+		if err := os.Rename(partial, fpath); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// downloads task inputs from and uploads task outputs to the master
+type Stager struct {
+	master string
+	apikey string
+}
+
+func NewStager(master string, apikey string) *Stager {
+	return &Stager{master: master, apikey: apikey}
+}
+
+func (this *Stager) Url(path string) string {
+	u := url.URL{Scheme: "http", Host: this.master, Path: path}
+	if useTls {
+		u.Scheme = "https"
+	}
+	return u.String()
+}
+
+// downloads each of the job's inputs into dir keeping their relative paths
+func (this *Stager) StageIn(job *WorkerJob, dir string) error {
+	logger.Debug("StageIn(%v,%v)", job.SubId, dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, input := range job.Inputs {
+		if err := this.Download("/stage/in/"+input, SafeJoin(dir, input)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploads every file in dir matching one of the job's output patterns
+func (this *Stager) StageOut(job *WorkerJob, dir string) error {
+	logger.Debug("StageOut(%v,%v)", job.SubId, dir)
+	for _, pattern := range job.Outputs {
+		matches, err := filepath.Glob(SafeJoin(dir, pattern))
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if fi, err := os.Stat(match); err != nil || fi.IsDir() {
+				continue
+			}
+			rel, err := filepath.Rel(dir, match)
+			if err != nil {
+				return err
+			}
+			if err := this.Upload(job, filepath.ToSlash(rel), match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// downloads the file at urlpath on the master to dest verifying its size and checksum
+func (this *Stager) Download(urlpath string, dest string) error {
+	logger.Debug("Download(%v,%v)", urlpath, dest)
+	rel := path.Base(urlpath)
+	r, err := http.NewRequest("GET", this.Url(urlpath), nil)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("x-golem-apikey", this.apikey)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("staging in %v: %v", rel, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, stagemaxbytes+1))
+	if err != nil {
+		return err
+	}
+	if n > stagemaxbytes {
+		return fmt.Errorf("staging in %v: larger than %d bytes", rel, stagemaxbytes)
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != resp.Trailer.Get(checksumHeader) {
+		return errors.New("staging in " + rel + ": checksum mismatch")
+	}
+	return nil
+}
+
+func (this *Stager) Upload(job *WorkerJob, rel string, src string) error {
+	logger.Debug("Upload(%v,%v)", rel, src)
+	sum, size, err := FileChecksum(src)
+	if err != nil {
+		return err
+	}
+	if size > stagemaxbytes {
+		return fmt.Errorf("staging out %v: larger than %d bytes", rel, stagemaxbytes)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := http.NewRequest("PUT", this.Url(fmt.Sprintf("/stage/out/%v/%d/%d/%v", job.SubId, job.LineId, job.JobId, rel)), f)
+	if err != nil {
+		return err
+	}
+	r.ContentLength = size
+	r.Header.Set("x-golem-apikey", this.apikey)
+	r.Header.Set(checksumHeader, sum)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("staging out %v: %v", rel, resp.Status)
+	}
+	return nil
+}
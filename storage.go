@@ -36,7 +36,15 @@ type JobStore interface {
 
 	Update(JobDetails) error
 
+	SaveResults(jobId string, results []TaskResult) error
+
+	Results(jobId string) ([]TaskResult, error)
+
 	SnapshotCluster(ClusterStat) error
 
 	ClusterStats(numberOfSecondsSince int64) ([]ClusterStat, error)
+
+	SnapshotNode(NodeStat) error
+
+	NodeStats(nodeId string, numberOfSecondsSince int64) ([]NodeStat, error)
 }
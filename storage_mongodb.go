@@ -20,6 +20,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"labix.org/v1/mgo"
 	"labix.org/v1/mgo/bson"
@@ -30,6 +31,8 @@ const (
 	JOBS          = "jobs"
 	TASKS         = "tasks"
 	CLUSTER_STATS = "cluster_stats"
+	NODE_STATS    = "node_stats"
+	RESULTS       = "results"
 )
 
 func NewMongoJobStore(dbhost string, dbstore string) *MongoJobStore {
@@ -129,6 +132,65 @@ func (this *MongoJobStore) Update(item JobDetails) (err error) {
 	return jobsCollection.Update(bson.M{"jobid": item.JobId}, existing)
 }
 
+// a task result as stored, the record is kept as a document so it can be queried
+type StoredResult struct {
+	JobId   string
+	LineId  int
+	TaskId  int
+	Attempt int
+	Result  interface{}
+}
+
+// replaces the stored results of a job and marks them saved on the job, even if there are none
+func (this *MongoJobStore) SaveResults(jobId string, results []TaskResult) (err error) {
+	logger.Debug("SaveResults(%v,%d)", jobId, len(results))
+	resultsCollection := this.Database.C(RESULTS)
+
+	if _, err = resultsCollection.RemoveAll(bson.M{"jobid": jobId}); err != nil {
+		logger.Warn(err)
+		return
+	}
+
+	if len(results) > 0 {
+		docs := make([]interface{}, 0, len(results))
+		for _, r := range results {
+			sr := StoredResult{JobId: jobId, LineId: r.LineId, TaskId: r.TaskId, Attempt: r.Attempt}
+			if err = json.Unmarshal(r.Result, &sr.Result); err != nil {
+				logger.Warn(err)
+				return
+			}
+			docs = append(docs, sr)
+		}
+		if err = resultsCollection.Insert(docs...); err != nil {
+			return
+		}
+	}
+
+	jobsCollection := this.Database.C(JOBS)
+	return jobsCollection.Update(bson.M{"jobid": jobId}, bson.M{"$set": bson.M{"resultssaved": true}})
+}
+
+func (this *MongoJobStore) Results(jobId string) (items []TaskResult, err error) {
+	logger.Debug("Results(%v)", jobId)
+
+	resultsCollection := this.Database.C(RESULTS)
+	iter := resultsCollection.Find(bson.M{"jobid": jobId}).Iter()
+
+	for {
+		sr := StoredResult{}
+		if !iter.Next(&sr) {
+			err = iter.Err()
+			break
+		}
+		result, err := json.Marshal(sr.Result)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, TaskResult{LineId: sr.LineId, TaskId: sr.TaskId, Attempt: sr.Attempt, Result: result})
+	}
+	return
+}
+
 func (this *MongoJobStore) FindJobs(m map[string]interface{}) (items []JobDetails, err error) {
 	logger.Debug("FindJobs(%v)", m)
 
@@ -158,6 +220,37 @@ func (this *MongoJobStore) SnapshotCluster(snapshot ClusterStat) error {
 	return collection.Insert(snapshot)
 }
 
+func (this *MongoJobStore) SnapshotNode(snapshot NodeStat) error {
+	collection := this.Database.C(NODE_STATS)
+	return collection.Insert(snapshot)
+}
+
+func (this *MongoJobStore) NodeStats(nodeId string, numberOfSecondsSince int64) (items []NodeStat, err error) {
+	logger.Debug("NodeStats(%v,%d)", nodeId, numberOfSecondsSince)
+
+	collection := this.Database.C(NODE_STATS)
+
+	m := bson.M{"nodeid": nodeId}
+	if numberOfSecondsSince > 0 {
+		since := time.Now().Add(-time.Duration(numberOfSecondsSince) * time.Second).UnixNano()
+		m["snapshotat"] = bson.M{"$gt": since}
+	}
+
+	iter := collection.Find(m).Iter()
+
+	for {
+		ns := NodeStat{}
+		if !iter.Next(&ns) {
+			logger.Warn(iter.Err())
+			break
+		}
+		items = append(items, ns)
+	}
+
+	logger.Debug("NodeStats(%v,%d):%d", nodeId, numberOfSecondsSince, len(items))
+	return
+}
+
 func (this *MongoJobStore) ClusterStats(numberOfSecondsSince int64) (items []ClusterStat, err error) {
 	logger.Debug("ClusterStats(%d)", numberOfSecondsSince)
 
@@ -83,7 +83,7 @@ func ConfigListenAndServeTLS(hostname string) (err error) {
 		return
 	}
 
-	if err := http.Serve(listener, nil); err != nil {
+	if err := http.Serve(listener, WithRequests(http.DefaultServeMux)); err != nil {
 		logger.Warn(err)
 	}
 	return
@@ -152,7 +152,7 @@ func ListenAndServeTLSorNot(hostname string) (err error) {
 			logger.Warn(err)
 		}
 	} else {
-		if err = http.ListenAndServe(hostname, nil); err != nil {
+		if err = http.ListenAndServe(hostname, WithRequests(http.DefaultServeMux)); err != nil {
 			logger.Warn(err)
 		}
 	}
@@ -21,7 +21,12 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 func UniqueId() string {
@@ -32,3 +37,40 @@ func UniqueId() string {
 	}
 	return fmt.Sprintf("%x", subId)
 }
+
+// the file a worker's id is kept in, nodeidfile if it is set. otherwise each worker process on a host gets its own
+// file, named for the host and a hash of its configuration file and processes, so workers sharing a home directory
+// don't take over each other's connections
+func NodeIdPath(processes int) string {
+	if nodeidfile != "" {
+		return nodeidfile
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Warn(err)
+	}
+	config := configpath
+	if abs, err := filepath.Abs(configpath); err == nil {
+		config = abs
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%v %d", config, processes)))
+	return filepath.Join(os.Getenv("HOME"), ".golem", fmt.Sprintf("nodeid-%v-%x", hostname, hash[:4]))
+}
+
+// reads the id saved in idfile, creating and saving a new one if there is none, so a worker keeps its id across restarts
+func PersistentId(idfile string) string {
+	logger.Debug("PersistentId(%v)", idfile)
+	if data, err := ioutil.ReadFile(idfile); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id
+		}
+	}
+
+	id := UniqueId()
+	if err := os.MkdirAll(filepath.Dir(idfile), 0755); err != nil {
+		logger.Warn(err)
+	} else if err := ioutil.WriteFile(idfile, []byte(id+"\n"), 0644); err != nil {
+		logger.Warn(err)
+	}
+	return id
+}
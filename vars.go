@@ -22,6 +22,7 @@ package main
 import (
 	"github.com/dlintw/goconf"
 	"os"
+	"path/filepath"
 	"runtime"
 )
 
@@ -31,10 +32,35 @@ const (
 
 var iobuffersize = 1000
 var conbuffersize = 10
+var batchmillis = 20
+var batchbytes = 65536
+var framecompression string = NOCOMPRESSION
 var iomonitors = 2
+var checkinseconds = 60
 var useTls bool = true
 var certpath string = ""
 var certorg string = "golem.googlecode.com"
+var stagedir string = "."
+var stagemaxbytes int64 = 1 << 30
+var scratchdir string = os.TempDir()
+var pathmap PathMap
+var opportunistic bool = false
+var idleload float64 = 0.5
+var idleseconds = 300
+var drainseconds = 60
+var nodeidfile string = "" // defaults to a file named for the host, configuration file and processes, see NodeIdPath
+var configpath string = "golem.config"
+var reconnectseconds = 60
+var maxattempts = 3
+var outputcompression string = NOCOMPRESSION
+var outputroot string = "."
+var outputlimits OutputLimits
+var outputsink string = "local"
+var outputsinks = map[string]OutputSink{"local": LocalSink{}}
+var outputname string = "{jobid}"
+var joblogformat string = JSONLOG
+var minprotocolversion = 1
+var executors = map[string]Executor{"direct": DirectExecutor{}, "shell": ShellExecutor{"/bin/sh"}}
 
 // Sets global variable to enable TLS communications and other related variables (certificate path, organization)
 // optional parameters:  default.certpath, default.organization, default.tls
@@ -93,6 +119,242 @@ func ConBufferSize(section string, config *goconf.ConfigFile) {
 	}
 }
 
+// Sets global variables configuring how output messages are batched into frames sent over connections
+// optional parameters:  [section].batchmillis (0 sends each message as it comes), [section].batchbytes, [section].framecompression (none, gzip or zstd)
+func FrameConfig(section string, config *goconf.ConfigFile) {
+	if value, err := config.GetInt(section, "batchmillis"); err == nil {
+		batchmillis = value
+	}
+	if value, err := config.GetInt(section, "batchbytes"); err == nil {
+		batchbytes = value
+	}
+	if value, err := config.GetString(section, "framecompression"); err == nil {
+		if err := ValidCompression(value); err != nil {
+			logger.Warn(err)
+		} else {
+			framecompression = value
+		}
+	}
+	logger.Printf("batchmillis=[%v] batchbytes=[%v] framecompression=[%v]", batchmillis, batchbytes, framecompression)
+}
+
+// Sets global variables used to stage task files between master and workers
+// optional parameters:  master.stagedir, worker.scratchdir, [section].stagemaxbytes
+func StageConfig(section string, config *goconf.ConfigFile) {
+	if dir, err := config.GetString(section, "stagedir"); err == nil {
+		stagedir = dir
+	}
+	logger.Printf("stagedir=[%v]", stagedir)
+
+	if dir, err := config.GetString(section, "scratchdir"); err == nil {
+		scratchdir = dir
+	}
+	logger.Printf("scratchdir=[%v]", scratchdir)
+
+	maxbytes, err := config.GetInt(section, "stagemaxbytes")
+	if err != nil {
+		logger.Warn(err)
+	} else {
+		stagemaxbytes = int64(maxbytes)
+	}
+	logger.Printf("stagemaxbytes=[%v]", stagemaxbytes)
+}
+
+// Sets global path prefix rewrites applied to the executable, arguments and working directory of tasks
+// optional parameters:  worker.pathmap (comma separated from:to pairs, e.g. /net/data:/data)
+func PathMapConfig(config *goconf.ConfigFile) {
+	value, err := config.GetString("worker", "pathmap")
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	if pathmap, err = ParsePathMap(value); err != nil {
+		logger.Fatalf("[CONFIG] %v", err)
+	}
+	logger.Printf("pathmap=[%v]", pathmap)
+}
+
+// Sets global variables for workers that only use spare cycles
+// optional parameters:  worker.opportunistic, worker.idleload, worker.idleseconds
+func OpportunisticConfig(config *goconf.ConfigFile) {
+	if value, err := config.GetBool("worker", "opportunistic"); err == nil {
+		opportunistic = value
+	}
+	if value, err := config.GetFloat64("worker", "idleload"); err == nil {
+		idleload = value
+	}
+	if value, err := config.GetInt("worker", "idleseconds"); err == nil {
+		idleseconds = value
+	}
+	logger.Printf("opportunistic=[%v] idleload=[%v] idleseconds=[%v]", opportunistic, idleload, idleseconds)
+}
+
+//get the number of seconds a worker waits for running tasks to finish when asked to shut down
+func DrainSeconds(config *goconf.ConfigFile) {
+	secs, err := config.GetInt("worker", "drainseconds")
+	if err != nil {
+		logger.Warn(err)
+	} else if secs >= 0 {
+		drainseconds = secs
+	}
+	logger.Printf("drainseconds=[%v]", drainseconds)
+}
+
+//get the file a worker keeps its node id in so it is recognized when it reconnects or restarts
+func NodeIdFile(config *goconf.ConfigFile) {
+	if value, err := config.GetString("worker", "nodeidfile"); err == nil {
+		nodeidfile = os.ExpandEnv(value)
+	}
+	logger.Printf("nodeidfile=[%v]", nodeidfile)
+}
+
+// Sets global variables controlling how long the master waits for a disconnected worker and how often lost tasks are retried
+// optional parameters:  master.reconnectseconds, master.maxattempts
+func ReconnectConfig(config *goconf.ConfigFile) {
+	if secs, err := config.GetInt("master", "reconnectseconds"); err == nil && secs >= 0 {
+		reconnectseconds = secs
+	}
+	if attempts, err := config.GetInt("master", "maxattempts"); err == nil && attempts > 0 {
+		maxattempts = attempts
+	}
+	logger.Printf("reconnectseconds=[%v] maxattempts=[%v]", reconnectseconds, maxattempts)
+}
+
+// Sets the directory the master writes job files under and the template each job's subdirectory is named with,
+// the root is made absolute so it can be reported in job details
+// optional parameters:  master.outputroot (defaults to the working directory), master.outputname (defaults to {jobid}, e.g. {owner}/{date}/{label}-{jobid})
+func OutputConfig(config *goconf.ConfigFile) {
+	if value, err := config.GetString("master", "outputroot"); err == nil && value != "" {
+		outputroot = os.ExpandEnv(value)
+	}
+	if abs, err := filepath.Abs(outputroot); err != nil {
+		logger.Warn(err)
+	} else {
+		outputroot = abs
+	}
+	if value, err := config.GetString("master", "outputname"); err == nil {
+		outputname = value
+	}
+	logger.Printf("outputroot=[%v] outputname=[%v]", outputroot, outputname)
+}
+
+// Sets the output limits of jobs that don't ask for their own
+// optional parameters:  master.outputlimits (e.g. taskbytes=10485760,jobbytes=1073741824,kill)
+func OutputLimitsConfig(config *goconf.ConfigFile) {
+	if value, err := config.GetString("master", "outputlimits"); err == nil {
+		if limits, err := ParseOutputLimits(value); err != nil {
+			logger.Warn(err)
+		} else {
+			outputlimits = limits
+		}
+	}
+	logger.Printf("outputlimits=[%v]", outputlimits)
+}
+
+// Adds the output sinks jobs can select by name, each option is a name and an http, https or s3 url, and sets the
+// sink used by jobs that don't select one
+// optional section:  sinks (e.g. archive = s3://golem-output/runs?endpoint=http://localhost:9000)
+// optional parameters:  master.outputsink (defaults to local)
+func OutputSinkConfig(config *goconf.ConfigFile) {
+	if options, err := GetSectionOptions(config, "sinks"); err == nil {
+		for _, name := range options {
+			value, err := config.GetString("sinks", name)
+			if err != nil {
+				logger.Warn(err)
+				continue
+			}
+			sink, err := NewOutputSink(value)
+			if err != nil {
+				logger.Fatalf("[CONFIG] sink %v: %v", name, err)
+			}
+			outputsinks[name] = sink
+			logger.Printf("sink %v=[%v]", name, value)
+		}
+	}
+
+	if value, err := config.GetString("master", "outputsink"); err == nil && value != "" {
+		if _, isin := outputsinks[value]; !isin {
+			logger.Fatalf("[CONFIG] unknown output sink %v", value)
+		}
+		outputsink = value
+	}
+	logger.Printf("outputsink=[%v]", outputsink)
+}
+
+// Sets the compression of job output files when a job doesn't ask for one
+// optional parameters:  master.compression (none, gzip or zstd)
+func CompressionConfig(config *goconf.ConfigFile) {
+	if value, err := config.GetString("master", "compression"); err == nil {
+		if err := ValidCompression(value); err != nil {
+			logger.Warn(err)
+		} else {
+			outputcompression = value
+		}
+	}
+	logger.Printf("compression=[%v]", outputcompression)
+}
+
+// get the oldest protocol version the master accepts workers speaking, workers that give no version speak version 1
+// optional section:  master (e.g. minprotocol = 2)
+func ProtocolConfig(config *goconf.ConfigFile) {
+	if value, err := config.GetInt("master", "minprotocol"); err == nil {
+		if value > protocolversion {
+			logger.Printf("minprotocol %d is newer than this master's protocol version %d", value, protocolversion)
+		} else {
+			minprotocolversion = value
+		}
+	}
+	logger.Printf("minprotocol=[%v] protocol=[%v]", minprotocolversion, protocolversion)
+}
+
+// get the format of job logs
+// optional section:  master (e.g. joblog = text)
+func JobLogConfig(config *goconf.ConfigFile) {
+	if value, err := config.GetString("master", "joblog"); err == nil {
+		if err := ValidLogFormat(value); err != nil {
+			logger.Warn(err)
+		} else {
+			joblogformat = value
+		}
+	}
+	logger.Printf("joblog=[%v]", joblogformat)
+}
+
+// Adds the wrapper executors tasks can select by name, each option is a name and the launcher tasks are prefixed with
+// optional section:  executors (e.g. lowpriority = nice -n 19)
+func ExecutorConfig(config *goconf.ConfigFile) {
+	options, err := GetSectionOptions(config, "executors")
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+
+	for _, name := range options {
+		launcher, err := config.GetString("executors", name)
+		if err != nil {
+			logger.Warn(err)
+			continue
+		}
+		wrapper, err := NewWrapperExecutor(launcher)
+		if err != nil {
+			logger.Fatalf("[CONFIG] executor %v: %v", name, err)
+		}
+		executors[name] = wrapper
+		logger.Printf("executor %v=[%v]", name, launcher)
+	}
+}
+
+//get the number of seconds between worker check-ins
+func CheckInSeconds(config *goconf.ConfigFile) {
+	secs, err := config.GetInt("worker", "checkinseconds")
+	if err != nil {
+		logger.Warn(err)
+	} else if secs > 0 {
+		checkinseconds = secs
+	}
+	logger.Printf("checkinseconds=[%v]", checkinseconds)
+}
+
 //get the number of IO monitors to run per node
 func IOMOnitors(config *goconf.ConfigFile) {
 	iomons, err := config.GetInt("master", "iomonitors")
@@ -125,3 +387,25 @@ func GetRequiredString(config *goconf.ConfigFile, section string, key string) (v
 	}
 	return
 }
+
+//convenience function for listing the options set in a section, goconf lists those of the default section in every section
+func GetSectionOptions(config *goconf.ConfigFile, section string) (options []string, err error) {
+	names, err := config.GetOptions(section)
+	if err != nil {
+		return
+	}
+	defaults := map[string]bool{}
+	if section != "default" {
+		if names, err := config.GetOptions("default"); err == nil {
+			for _, name := range names {
+				defaults[name] = true
+			}
+		}
+	}
+	for _, name := range names {
+		if !defaults[name] {
+			options = append(options, name)
+		}
+	}
+	return
+}